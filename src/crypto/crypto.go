@@ -21,7 +21,9 @@ package crypto
 import (
     "ExchatgeServer/utils"
     xBytes "bytes"
+    "encoding/hex"
     "github.com/jamesruan/sodium"
+    "strings"
     "unsafe"
 )
 
@@ -35,8 +37,12 @@ const SignatureSize uint = 64
 const intSize = 4
 const tokenUnencryptedValueSize = 2 * intSize // 8
 const tokenTrailingSize uint = 16
+const resumeTokenUnencryptedValueSize = intSize + 8 // 12 = userId & issue time in milliseconds
 const TokenSize = tokenUnencryptedValueSize + 40 + tokenTrailingSize // 48 + 16 = 64 = 2 encrypted ints + mac + nonce + missing bytes to reach signatureSize so the server can tokenize itself via signature whereas for clients server encrypts 2 ints (connectionId, userId)
 const SecretKeySize = SignatureSize
+const SignPublicKeySize uint = 32
+const fingerprintSize uint = 16
+const SignKeysAnnouncementSize = SignPublicKeySize * 3 + SignatureSize * 2 + 8 * 2 // 240 = active key, next key, cutover millis, next key's signature, previous key, active key's signature by the previous one, grace end millis
 
 type Coders struct {
     encoderBuffer *xBytes.Buffer
@@ -47,20 +53,50 @@ type Coders struct {
 
 var signSecretKey sodium.SignSecretKey
 
-var tokenEncryptionKey = func() []byte {
+var nextSignSecretKey *sodium.SignSecretKey = nil // replaces signSecretKey at the cutover in everything the server signs, signSecretKey then only endorses it till the grace period ends
+
+var signKeyCutoverMillis uint64 = 0
+
+var signKeyGraceMillis uint64 = 0
+
+var tokenEncryptionKey = GenerateKey() // tokens live as long as the connections they're bound to
+
+var resumeTokenEncryptionKey []byte = nil // persisted, so resume tokens survive restarts
+
+func Initialize(serverSignSecretKey []byte) { signSecretKey = sodium.SignSecretKey{Bytes: serverSignSecretKey} } // the sodium library is initialized via it's core module's init() - the language's feature to set up each file's state
+
+func InitializeRotation(nextServerSignSecretKey []byte, cutoverMillis uint64, graceMillis uint64) {
+    utils.Assert(uint(len(nextServerSignSecretKey)) == SecretKeySize && cutoverMillis > 0)
+    nextSignSecretKey = &sodium.SignSecretKey{Bytes: nextServerSignSecretKey}
+    signKeyCutoverMillis = cutoverMillis
+    signKeyGraceMillis = graceMillis
+}
+
+func SignKeyRotated() bool { return nextSignSecretKey != nil && utils.CurrentTimeMillis() >= signKeyCutoverMillis } // whether the next key signs instead of the initial one
+
+func activeSignKey() sodium.SignSecretKey {
+    if SignKeyRotated() { return *nextSignSecretKey } else { return signSecretKey }
+}
+
+func InitializeResumeTokens(key []byte) {
+    utils.Assert(uint(len(key)) == KeySize)
+    resumeTokenEncryptionKey = key
+}
+
+func GenerateKey() []byte {
     key := new(sodium.SecretBoxKey)
     sodium.Randomize(key)
     utils.Assert(len(key.Bytes) == int(KeySize))
     return key.Bytes
-}()
-
-func Initialize(serverSignSecretKey []byte) { signSecretKey = sodium.SignSecretKey{Bytes: serverSignSecretKey} } // the sodium library is initialized via it's core module's init() - the language's feature to set up each file's state
+}
 
 func GenerateServerKeys() ([]byte, []byte) {
     serverKeys := sodium.MakeKXKP()
     return serverKeys.PublicKey.Bytes, serverKeys.SecretKey.Bytes
 }
 
+func Wipe(bytes []byte) { if len(bytes) > 0 { sodium.MemZero(bytes) } } // unlike a plain loop, can't be optimized away
+
 func EncryptedSize(unencryptedSize uint) uint { return unencryptedSize + encryptedAdditionalBytesSize }
 func EncryptedSingleSize(unencryptedSize uint) uint { return macSize + unencryptedSize + nonceSize }
 
@@ -125,9 +161,10 @@ func (coders *Coders) Encrypt(bytes []byte) []byte { // nillable result
     return encrypted
 }
 
-func (coders *Coders) Decrypt(bytes []byte) []byte {
+func (coders *Coders) Decrypt(bytes []byte) []byte { // nillable result
     bytesSize := uint(len(bytes))
-    utils.Assert(bytesSize > 0 && coders.encoder != nil && coders.decoder != nil)
+    utils.Assert(coders.encoder != nil && coders.decoder != nil)
+    if bytesSize <= encryptedAdditionalBytesSize { return nil }
     coders.decoderBuffer.Write(bytes)
 
     decryptedSize := bytesSize - encryptedAdditionalBytesSize
@@ -161,11 +198,47 @@ func CompareWithHash(hash []byte, unhashed []byte) bool {
     return sodium.LoadPWHashStr(hash).PWHashVerify(string(unhashed)) == nil
 }
 
-func Sign(bytes []byte) []byte {
+func GenerateSignKeys() ([]byte, []byte) { // returns public & secret keys for signing, the latter is what Initialize expects
+    keys := sodium.MakeSignKP()
+    utils.Assert(len(keys.PublicKey.Bytes) == int(SignPublicKeySize) && len(keys.SecretKey.Bytes) == int(SecretKeySize))
+    return keys.PublicKey.Bytes, keys.SecretKey.Bytes
+}
+
+func SignPublicKey() []byte { // of the key passed to Initialize
+    utils.Assert(len(signSecretKey.Bytes) == int(SecretKeySize))
+    return signSecretKey.PublicKey().Bytes
+}
+
+func CheckSignSecretKey(serverSignSecretKey []byte) bool { // whether the key is an ed25519 secret key, the seed followed by the public key derived from it
+    if uint(len(serverSignSecretKey)) != SecretKeySize { return false }
+
+    seed := sodium.SignSeed{Bytes: serverSignSecretKey[:SecretKeySize - SignPublicKeySize]}
+    return xBytes.Equal(sodium.SeedSignKP(seed).SecretKey.Bytes, serverSignSecretKey)
+}
+
+func VerifySignature(signed []byte, publicKey []byte) []byte { // nillable result, returns the unsigned bytes if the signature is valid
+    if len(signed) <= int(SignatureSize) || uint(len(publicKey)) != SignPublicKeySize { return nil }
+
+    unsigned, err := sodium.Bytes(signed).SignOpen(sodium.SignPublicKey{Bytes: publicKey})
+    if err != nil { return nil }
+    return unsigned
+}
+
+func Fingerprint(publicKey []byte) string { // a short hash of the key for people to compare, like 1a2b:3c4d:...
+    hash := GenericHash(publicKey, fingerprintSize)
+
+    groups := make([]string, 0, fingerprintSize / 2)
+    for i := uint(0); i < fingerprintSize; i += 2 { groups = append(groups, hex.EncodeToString(hash[i:i + 2])) }
+    return strings.Join(groups, ":")
+}
+
+func Sign(bytes []byte) []byte { return signWith(activeSignKey(), bytes) } // with the next key after the cutover, the handshake included, as are the server's tokens
+
+func signWith(key sodium.SignSecretKey, bytes []byte) []byte {
     bytesSize := len(bytes)
     utils.Assert(bytesSize > 0)
 
-    result := sodium.Bytes(bytes).Sign(signSecretKey)
+    result := sodium.Bytes(bytes).Sign(key)
     utils.Assert(len(result) == int(SignatureSize) + bytesSize)
 
     return result
@@ -231,14 +304,52 @@ func OpenToken(withTrailing [TokenSize]byte) (*uint32, *uint32) { // nillable re
     return connectionId, userId
 }
 
-func MakeServerToken(messageBodySize uint) [TokenSize]byte { // letting clients to verify server's signature
+//goland:noinspection GoRedundantConversion for (*byte) as without this it won't compile
+func MakeResumeToken(userId uint32, issuedMillis uint64) [TokenSize]byte { // unlike the token, isn't bound to a connection, so the user can log in again without credentials
+    utils.Assert(resumeTokenEncryptionKey != nil)
+    bytes := make([]byte, resumeTokenUnencryptedValueSize)
+
+    copy(bytes, unsafe.Slice((*byte) (unsafe.Pointer(&userId)), intSize))
+    copy(unsafe.Slice(&(bytes[intSize]), 8), unsafe.Slice((*byte) (unsafe.Pointer(&issuedMillis)), 8))
+
+    encrypted := EncryptSingle(bytes, resumeTokenEncryptionKey)
+    utils.Assert(len(encrypted) <= int(TokenSize))
+
+    withTrailing := [TokenSize]byte{}
+    copy(unsafe.Slice(&(withTrailing[0]), TokenSize), encrypted)
+
+    return withTrailing
+}
+
+//goland:noinspection GoRedundantConversion for (*byte) as without this it won't compile
+func OpenResumeToken(withTrailing [TokenSize]byte) (*uint32, *uint64) { // nillable results
+    utils.Assert(resumeTokenEncryptionKey != nil)
+
+    decrypted := DecryptSingle(withTrailing[:EncryptedSingleSize(resumeTokenUnencryptedValueSize)], resumeTokenEncryptionKey)
+    if decrypted == nil || len(decrypted) != resumeTokenUnencryptedValueSize { return nil, nil }
+
+    userId := new(uint32); issuedMillis := new(uint64)
+    copy(unsafe.Slice((*byte) (unsafe.Pointer(userId)), intSize), decrypted)
+    copy(unsafe.Slice((*byte) (unsafe.Pointer(issuedMillis)), 8), unsafe.Slice(&(decrypted[intSize]), 8))
+
+    return userId, issuedMillis
+}
+
+func MakeServerToken(messageBodySize uint) [TokenSize]byte { return makeServerToken(activeSignKey(), messageBodySize) } // letting clients to verify server's signature
+
+func MakeNextServerToken(messageBodySize uint) [TokenSize]byte { // signed by the next key, zeroes if there's none
+    if nextSignSecretKey == nil { return [TokenSize]byte{} }
+    return makeServerToken(*nextSignSecretKey, messageBodySize)
+}
+
+func makeServerToken(key sodium.SignSecretKey, messageBodySize uint) [TokenSize]byte {
     //goland:noinspection GoBoolExpressions - just to make sure
     utils.Assert(TokenSize == SignatureSize)
 
     unsigned := make([]byte, tokenUnencryptedValueSize)
     for i := range unsigned { unsigned[i] = (1 << 8) - 1 } // 255
 
-    signed := Sign(unsigned)
+    signed := signWith(key, unsigned)
     utils.Assert(len(signed) - tokenUnencryptedValueSize == int(SignatureSize))
 
     var arr [TokenSize]byte
@@ -247,6 +358,36 @@ func MakeServerToken(messageBodySize uint) [TokenSize]byte { // letting clients
     return arr
 }
 
+//goland:noinspection GoRedundantConversion for (*byte) as without this it won't compile
+func MakeSignKeysAnnouncement() [SignKeysAnnouncementSize]byte { // lets clients pin the next key before the cutover & follow the rotation after it, unused parts are zeroes
+    var announcement [SignKeysAnnouncementSize]byte
+    activeKey := announcement[:SignPublicKeySize]
+    nextKey := announcement[SignPublicKeySize:SignPublicKeySize * 2]
+    cutoverMillis := announcement[SignPublicKeySize * 2:SignPublicKeySize * 2 + 8]
+    nextKeySignature := announcement[SignPublicKeySize * 2 + 8:SignPublicKeySize * 2 + 8 + SignatureSize]
+    previousKey := announcement[SignPublicKeySize * 2 + 8 + SignatureSize:SignPublicKeySize * 3 + 8 + SignatureSize]
+    activeKeySignature := announcement[SignPublicKeySize * 3 + 8 + SignatureSize:SignPublicKeySize * 3 + 8 + SignatureSize * 2]
+    graceEndMillis := announcement[SignPublicKeySize * 3 + 8 + SignatureSize * 2:]
+
+    copy(activeKey, activeSignKey().PublicKey().Bytes)
+    if nextSignSecretKey == nil { return announcement }
+
+    nextPublicKey := nextSignSecretKey.PublicKey().Bytes
+    xGraceEndMillis := signKeyCutoverMillis + signKeyGraceMillis
+
+    if !SignKeyRotated() {
+        copy(nextKey, nextPublicKey)
+        copy(cutoverMillis, unsafe.Slice((*byte) (unsafe.Pointer(&signKeyCutoverMillis)), 8))
+        copy(nextKeySignature, signWith(signSecretKey, announcement[SignPublicKeySize:SignPublicKeySize * 2 + 8])[:SignatureSize]) // the next key & the cutover are endorsed by the current key
+    } else if utils.CurrentTimeMillis() < xGraceEndMillis {
+        copy(previousKey, signSecretKey.PublicKey().Bytes)
+        copy(activeKeySignature, signWith(signSecretKey, nextPublicKey)[:SignatureSize]) // clients which haven't pinned the new key yet can still verify it with the old one
+        copy(graceEndMillis, unsafe.Slice((*byte) (unsafe.Pointer(&xGraceEndMillis)), 8))
+    }
+
+    return announcement
+}
+
 ////////////////////////////////
 
 //goland:noinspection GoSnakeCaseUsage
@@ -19,6 +19,7 @@
 package crypto
 
 import (
+    "ExchatgeServer/utils"
     "bytes"
     "testing"
     "time"
@@ -38,6 +39,13 @@ func TestKeyExchange(t *testing.T) {
     if !(bytes.Equal(clientKey, clientKey2) && bytes.Equal(serverKey2, serverKey2)) { t.Error() }
 }
 
+func TestWipe(t *testing.T) {
+    _, secretKey := GenerateServerKeys()
+    Wipe(secretKey)
+    if !bytes.Equal(secretKey, make([]byte, KeySize)) { t.Error() }
+    Wipe(nil)
+}
+
 func TestCoderStreams(t *testing.T) { // fmt.Printf("%v", key)
     clientKey := []byte{131, 3, 162, 82, 136, 103, 195, 49, 233, 142, 113, 208, 245, 145, 10, 229, 91, 199, 28, 252, 214, 171, 8, 249, 51, 93, 38, 178, 143, 222, 61, 17}
     serverKey := []byte{45, 188, 222, 137, 223, 50, 85, 239, 153, 62, 106, 87, 202, 63, 149, 150, 233, 242, 46, 12, 124, 105, 252, 169, 19, 233, 209, 152, 183, 234, 91, 104}
@@ -104,6 +112,22 @@ func TestToken(t *testing.T) {
     if connectionId != *xConnectionId || userId != *xUserId { t.Error() }
 }
 
+func TestResumeToken(t *testing.T) {
+    InitializeResumeTokens(GenerateKey())
+
+    userId := uint32(time.Now().UnixMilli() & 0x7fffffff)
+    issuedMillis := uint64(time.Now().UnixMilli())
+
+    token := MakeResumeToken(userId, issuedMillis)
+    xUserId, xIssuedMillis := OpenResumeToken(token)
+
+    if xUserId == nil || xIssuedMillis == nil { t.Error() }
+    if userId != *xUserId || issuedMillis != *xIssuedMillis { t.Error() }
+
+    InitializeResumeTokens(GenerateKey()) // a different key
+    if xUserId, xIssuedMillis = OpenResumeToken(token); xUserId != nil || xIssuedMillis != nil { t.Error() }
+}
+
 func TestServerToken(t *testing.T) {
     Initialize(make([]byte, SecretKeySize))
 
@@ -116,3 +140,55 @@ func TestServerToken(t *testing.T) {
 
     if !bytes.Equal(token[:], signature) { t.Error() }
 }
+
+func TestSignKeys(t *testing.T) {
+    publicKey, secretKey := GenerateSignKeys()
+    if !CheckSignSecretKey(secretKey) || CheckSignSecretKey(make([]byte, SecretKeySize)) || CheckSignSecretKey(secretKey[1:]) { t.Error() }
+
+    Initialize(secretKey)
+    if !bytes.Equal(SignPublicKey(), publicKey) { t.Error() }
+
+    signed := Sign([]byte{1, 2, 3})
+    if !bytes.Equal(VerifySignature(signed, publicKey), []byte{1, 2, 3}) { t.Error() }
+
+    signed[0]++
+    if VerifySignature(signed, publicKey) != nil { t.Error() }
+
+    fingerprint := Fingerprint(publicKey)
+    if len(fingerprint) != 39 || fingerprint != Fingerprint(publicKey) || fingerprint == Fingerprint(secretKey) { t.Error() }
+}
+
+func TestSignKeyRotation(t *testing.T) {
+    currentPublicKey, currentSecretKey := GenerateSignKeys()
+    nextPublicKey, nextSecretKey := GenerateSignKeys()
+    defer func() { nextSignSecretKey = nil }()
+
+    Initialize(currentSecretKey)
+    InitializeRotation(nextSecretKey, utils.CurrentTimeMillis() + 60000, 60000)
+
+    announcement := MakeSignKeysAnnouncement()
+    if SignKeyRotated() || VerifySignature(Sign([]byte{1}), currentPublicKey) == nil { t.Error() }
+    if !bytes.Equal(announcement[:SignPublicKeySize], currentPublicKey) || !bytes.Equal(announcement[SignPublicKeySize:SignPublicKeySize * 2], nextPublicKey) { t.Error() }
+
+    signed := append(append([]byte(nil), announcement[SignPublicKeySize * 2 + 8:SignPublicKeySize * 2 + 8 + SignatureSize]...), announcement[SignPublicKeySize:SignPublicKeySize * 2 + 8]...)
+    if VerifySignature(signed, currentPublicKey) == nil { t.Error() }
+
+    InitializeRotation(nextSecretKey, utils.CurrentTimeMillis() - 1, 60000) // within the grace period
+
+    announcement = MakeSignKeysAnnouncement()
+    if !SignKeyRotated() || VerifySignature(Sign([]byte{1}), nextPublicKey) == nil { t.Error() }
+    if VerifySignature(Sign([]byte{1}), currentPublicKey) != nil { t.Error() } // clients which have pinned only the previous key are rejected at the handshake
+    if !bytes.Equal(announcement[:SignPublicKeySize], nextPublicKey) || !bytes.Equal(announcement[SignPublicKeySize * 2 + 8 + SignatureSize:SignPublicKeySize * 3 + 8 + SignatureSize], currentPublicKey) { t.Error() }
+
+    signed = append(append([]byte(nil), announcement[SignPublicKeySize * 3 + 8 + SignatureSize:SignPublicKeySize * 3 + 8 + SignatureSize * 2]...), nextPublicKey...)
+    if VerifySignature(signed, currentPublicKey) == nil { t.Error() }
+
+    token := MakeServerToken(TokenSize)
+    if token != MakeNextServerToken(TokenSize) { t.Error() } // signed by the same key as the handshake
+
+    InitializeRotation(nextSecretKey, utils.CurrentTimeMillis() - 2, 1) // after the grace period
+
+    announcement = MakeSignKeysAnnouncement()
+    if !bytes.Equal(announcement[SignPublicKeySize:], make([]byte, SignKeysAnnouncementSize - SignPublicKeySize)) { t.Error() }
+    if VerifySignature(Sign([]byte{1}), nextPublicKey) == nil { t.Error() }
+}
@@ -16,253 +16,347 @@
  * along with this program.  If not, see <https://www.gnu.org/licenses/>.
  */
 
+
 package database
 
 import (
     "ExchatgeServer/crypto"
     xIdsPool "ExchatgeServer/idsPool"
+    "ExchatgeServer/metrics"
     "ExchatgeServer/utils"
-    "context"
-    "errors"
-    "go.mongodb.org/mongo-driver/bson"
-    "go.mongodb.org/mongo-driver/mongo"
-    "go.mongodb.org/mongo-driver/mongo/options"
-    "reflect"
-    "strings"
-    "sync"
+    "math"
 )
 
-const databaseName = "admin"
-const collectionUsers = "users"
-const collectionMessages = "messages"
-
-const fieldRealId = "_id"
-const fieldId = "id"
-const fieldName = "name"
-const fieldPassword = "password"
-
-const fieldTimestamp = "timestamp"
-const fieldFrom = "from"
-const fieldTo = "to"
-const fieldBody = "body"
-
 type User struct {
     Id uint32 `bson:"id"`
     Name []byte `bson:"name"`
     Password []byte `bson:"password"` // salty-hashed
+    Banned bool `bson:"banned"` // banned users can't log in
+    TokensRevokedMillis uint64 `bson:"tokensRevokedMillis"` // resume tokens issued before this moment are invalid
+    LastSeenMillis uint64 `bson:"lastSeenMillis"` // when the user has disconnected last time, 0 if never
 }
 
 type Message struct {
-    Timestamp uint64 `bson:"timestamp"`
+    Id uint64 `bson:"id"` // server-assigned, see NextMessageId
+    Timestamp uint64 `bson:"timestamp"` // set by the sender
+    ReceivedMillis uint64 `bson:"receivedMillis"` // set by the server, the retention policy relies on it as clients' timestamps aren't checked
     From uint32 `bson:"from"`
     To uint32 `bson:"to"`
-    Body []byte `bson:"body"`
+    Room uint32 `bson:"room"` // 0 for direct messages; a room message is stored once, with roomMessageRecipient as the recipient, and queued for each member
+    Body []byte `bson:"body"` // empty if deleted
+    EditedMillis uint64 `bson:"editedMillis"` // when the sender has edited or deleted the message last time, 0 if never
+    Deleted bool `bson:"deleted"` // a tombstone
+    Status uint8 `bson:"status"` // one of Message*, only goes up
 }
 
-func (user *User) passwordHashed() *User {
-    user.Password = crypto.Hash(user.Password)
-    return user
+type MessageCursor struct { // a position in a conversation, which is ordered by the timestamps and then by the ids, as several messages may share a timestamp
+    Timestamp uint64
+    Id uint64
 }
 
-type database struct {
-    ctx *context.Context
-    users *mongo.Collection
-    messages *mongo.Collection
-    client *mongo.Client
-    adminUsername []byte
-    adminPassword []byte
-    idsPool *xIdsPool.IdsPool
-    rwMutex sync.RWMutex
+func (cursor MessageCursor) precedes(other MessageCursor) bool {
+    return cursor.Timestamp < other.Timestamp || cursor.Timestamp == other.Timestamp && cursor.Id < other.Id
 }
-var this *database = nil
 
-func Initialize(maxUsersCount uint32, mongoUrl string, adminPassword []byte) {
-    ctx := context.TODO()
+func (message *Message) cursor() MessageCursor { return MessageCursor{message.Timestamp, message.Id} }
 
-    client, err := mongo.Connect(ctx, options.Client().ApplyURI(mongoUrl))
-    utils.Assert(err == nil)
+const roomMessageRecipient uint32 = math.MaxUint32 // no user has such an id, so the stored room messages never mix with the direct ones
 
-    this = &database{
-        &ctx,
-        client.Database(databaseName).Collection(collectionUsers),
-        client.Database(databaseName).Collection(collectionMessages),
-        client,
-        []byte{'a', 'd', 'm', 'i', 'n', 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
-        crypto.Hash(adminPassword),
-        xIdsPool.InitIdsPool(maxUsersCount),
-        sync.RWMutex{},
-    }
+const (
+    MessageStored uint8 = 0
+    MessageDelivered uint8 = 1 // handed to the recipient
+    MessageRead uint8 = 2 // reported by the recipient
+)
 
-    for i := range adminPassword { adminPassword[i] = 0 }
+type Room struct {
+    Id uint32 `bson:"id"` // starts from 1
+    Name []byte `bson:"name"`
+    Owner uint32 `bson:"owner"`
+}
 
-    addAdminIfNotExists()
-    mocData() // TODO: test only
-    loadIds()
+type Membership struct {
+    Room uint32 `bson:"room"`
+    User uint32 `bson:"user"`
 }
 
-func loadIds() {
-    for _, i := range GetAllUsers() {
-        this.idsPool.SetId(i.Id, true)
-    }
+const maxRoomsCount = 1 << 14 - 1 // the ids pool size mustn't be a multiple of 8
+
+type Storage interface { // users, messages & ids allocation; each implementation takes care of its own synchronization; errors are returned only on storage failures
+    AddAdminIfNotExists(username []byte, hashedPassword []byte)
+    FindUserByName(username []byte) (*User, error) // nillable first result
+    FindUserById(id uint32) (*User, error) // nillable first result
+    AddUser(username []byte, hashedPassword []byte) (*User, error) // nillable first result; takes an id for the new user, returns nil if the username is already in use or there are no ids left
+    GetAllUsers() ([]User, error)
+    FindUsers(prefix []byte, ids []uint32, fromId uint32, limit uint32) ([]User, error) // sorted by id, at most limit users starting from fromId whose names start with the prefix; nil ids mean any user, otherwise only those
+    GetUsersCount() (uint32, error)
+    UserExists(id uint32) (bool, error)
+    SetUserPassword(id uint32, hashedPassword []byte) error
+    SetUserName(id uint32, username []byte) (bool, error) // returns false if the username is already in use or there's no such user
+    SetUserBanned(id uint32, banned bool) (bool, error) // returns false if there's no such user
+    SetUserTokensRevokedMillis(id uint32, millis uint64) error
+    SetUserLastSeenMillis(id uint32, millis uint64) error
+    DeleteUser(id uint32) (bool, error) // along with the user's messages & queue, returns the id back to the pool; returns false if there's no such user
+    GetMessagesFromOrForUser(from bool, id uint32, afterTimestamp uint64) ([]Message, error) // sorted by timestamp
+    GetConversation(first uint32, second uint32, after MessageCursor, before MessageCursor, limit uint32, latest bool) ([]Message, error) // messages between the two users in both directions strictly between the cursors, at most limit of the latest or the earliest ones, sorted by timestamp and id
+    GetRoomMessages(room uint32, after MessageCursor, before MessageCursor, limit uint32, latest bool) ([]Message, error) // same as the previous one, but for the room
+    AddMessage(message Message) error
+    DeleteMessagesBefore(receivedMillis uint64) (uint64, error) // returns the count of the deleted messages, as the following two do
+    TrimMessages(maxPerSender uint32) (uint64, error) // deletes the earliest received messages of each sender beyond the limit
+    DeleteMessages(first uint32, second *uint32) (uint64, error) // of the first user in both directions or, if the second isn't nil, of the conversation between the two users
+    EnqueueMessage(message Message) error
+    GetQueuedMessages(to uint32) ([]Message, error) // sorted by timestamp
+    DequeueMessage(to uint32, id uint64) (bool, error) // returns true if the message was in the queue
+    SetMessageStatus(to uint32, id uint64, status uint8) (*Message, error) // nillable first result; returns the message as it was before the change, nil if there's no such message of the recipient or its status is the same or higher already
+    UpdateMessage(from uint32, id uint64, body []byte, editedMillis uint64) (*Message, error) // nillable first result; replaces the body of the sender's stored message and of its queued copies (one per member for a room message), an empty body tombstones the message; returns the message as it was, nil if there's no such message or it's a tombstone already
+    AddRoom(name []byte, owner uint32) (*Room, error) // nillable first result; takes an id for the new room, returns nil if there are no ids left
+    GetRoom(id uint32) (*Room, error) // nillable first result
+    SetRoomOwner(id uint32, owner uint32) error
+    DeleteRoom(id uint32) error // along with its memberships
+    AddRoomMember(room uint32, user uint32) (bool, error) // returns false if the user is a member already
+    RemoveRoomMember(room uint32, user uint32) (bool, error) // returns false if the user isn't a member
+    GetRoomMembers(room uint32) ([]uint32, error)
+    GetUserRooms(user uint32) ([]Room, error)
+    LoadOrStoreKey(name string, key []byte) ([]byte, error) // returns the stored key if there's one with that name, otherwise stores and returns the given one
+    GetIdsPools() (*xIdsPool.IdsPool, *xIdsPool.IdsPool) // users' & rooms'
+    Ping() error // checks whether the storage is reachable
+    Destroy()
 }
 
-func Destroy() {
-    this.rwMutex.Lock()
-    result := this.client.Database(databaseName).RunCommand(*(this.ctx), bson.D{{"shutdown", 1}})
+const StorageMongo = "mongodb"
+const StorageMemory = "memory"
 
-    utils.Assert(
-        result != nil &&
-        result.Err() != nil &&
-        strings.Contains(result.Err().Error(), "socket was unexpectedly closed: EOF"),
-    )
+const keyResumeTokens = "resumeTokens"
 
-    utils.Assert(this.client.Disconnect(*(this.ctx)) == nil)
-    this.rwMutex.Unlock()
-}
+var this Storage = nil // aka singleton
 
-func addAdminIfNotExists() { // admin is the only user that has id equal to 0
-    id := availableUserId()
-    utils.Assert(id != nil && *id == uint32(0))
+var adminUsername = []byte{'a', 'd', 'm', 'i', 'n', 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
 
-    if result := this.users.FindOne(
-        *(this.ctx),
-        bson.D{{fieldId, 0}, {fieldName, this.adminUsername}},
-    ); errors.Is(result.Err(), mongo.ErrNoDocuments) {
-        _, err := this.users.InsertOne(*(this.ctx), User{Id: *id, Name: this.adminUsername, Password: this.adminPassword})
-        utils.Assert(err == nil)
-    }
+func Initialize(storage Storage, adminPassword []byte) {
+    utils.Assert(this == nil && storage != nil)
+    this = &instrumentedStorage{storage}
+
+    usersIdsPool, roomsIdsPool := storage.GetIdsPools()
+    metrics.SetGauge("exchatge_ids_pool_occupancy", "Taken ids in each pool", "pool", func() map[string]float64 {
+        usersTaken, usersSize := usersIdsPool.Occupancy()
+        roomsTaken, roomsSize := roomsIdsPool.Occupancy()
+        return map[string]float64{"users": float64(usersTaken) / float64(usersSize), "rooms": float64(roomsTaken) / float64(roomsSize)}
+    })
+
+    this.AddAdminIfNotExists(adminUsername, crypto.Hash(adminPassword))
+    for i := range adminPassword { adminPassword[i] = 0 }
+
+    mocData() // TODO: test only
+}
+
+func Destroy() {
+    monitor.halt()
+    purger.halt()
+    this.Destroy()
+    this = nil
 }
 
 func mocData() { // TODO: test only
-    user1 := &User{1, []byte{'u', 's', 'e', 'r', '1', 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, crypto.Hash([]byte{'u', 's', 'e', 'r', '1', 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0})}
-    user2 := &User{2, []byte{'u', 's', 'e', 'r', '2', 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, crypto.Hash([]byte{'u', 's', 'e', 'r', '2', 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0})}
+    user1 := &User{1, []byte{'u', 's', 'e', 'r', '1', 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, crypto.Hash([]byte{'u', 's', 'e', 'r', '1', 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}), false, 0, 0}
+    user2 := &User{2, []byte{'u', 's', 'e', 'r', '2', 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, crypto.Hash([]byte{'u', 's', 'e', 'r', '2', 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}), false, 0, 0}
 
-    _ = AddUser(user1.Name, user1.Password)
-    _ = AddUser(user2.Name, user2.Password)
+    _, _ = AddUser(user1.Name, user1.Password)
+    _, _ = AddUser(user2.Name, user2.Password)
 }
 
 func IsAdmin(user *User) bool { return user.Id == 0 } // as users are being verified & authenticated right after establishing a connection
 
-func FindUser(username []byte, unhashedPassword []byte) *User { // nillable result
+func FindUser(username []byte, unhashedPassword []byte) (*User, error) { // nillable first result
     utils.Assert(len(username) > 0 && len(unhashedPassword) > 0)
 
-    this.rwMutex.RLock()
-    result := this.users.FindOne(*(this.ctx), bson.D{{fieldName, username}})
-    this.rwMutex.RUnlock()
+    user, err := this.FindUserByName(username)
+    if user == nil || err != nil { return nil, err }
 
-    if result.Err() != nil { return nil }
+    if crypto.CompareWithHash(user.Password, unhashedPassword) { return user, nil } else { return nil, nil }
+}
 
-    if user := new(User); result.Decode(user) == nil {
-        if crypto.CompareWithHash(user.Password, unhashedPassword) { return user } else { return nil }
-    } else {
-        return nil
-    }
+func FindUserById(id uint32) (*User, error) { return this.FindUserById(id) } // nillable first result
+
+func AddUser(username []byte, hashedPassword []byte) (*User, error) { // nillable first result
+    utils.Assert(len(username) > 0 && len(hashedPassword) == int(crypto.HashSize))
+    return this.AddUser(username, hashedPassword)
 }
 
-func usernameAlreadyInUse(username []byte) bool { // username must be unique
+func ChangePassword(user *User, oldUnhashedPassword []byte, newHashedPassword []byte) (bool, error) { // returns false if the old password doesn't match
+    utils.Assert(user != nil && len(oldUnhashedPassword) > 0 && len(newHashedPassword) == int(crypto.HashSize))
+
+    found, err := FindUser(user.Name, oldUnhashedPassword)
+    if found == nil || err != nil || found.Id != user.Id { return false, err }
+
+    if err = this.SetUserPassword(user.Id, newHashedPassword); err != nil { return false, err }
+    if err = RevokeResumeTokens(user.Id); err != nil { return false, err } // as the old password might have leaked
+    return true, nil
+}
+
+func RenameUser(id uint32, username []byte) (bool, error) { // returns false if the username is already in use
     utils.Assert(len(username) > 0)
-    result := this.users.FindOne(*(this.ctx), bson.D{{fieldName, username}})
-    return result.Err() == nil
+    return this.SetUserName(id, username)
 }
 
-func availableUserId() *uint32 { return this.idsPool.TakeId() }
+func SetUserBanned(id uint32, banned bool) (bool, error) { // returns false if there's no such user or it's the admin
+    if id == 0 { return false, nil }
 
-func AddUser(username []byte, hashedPassword []byte) *User { // nillable result
-    utils.Assert(len(username) > 0 && len(hashedPassword) == int(crypto.HashSize))
-    this.rwMutex.Lock()
+    updated, err := this.SetUserBanned(id, banned)
+    if !updated || err != nil || !banned { return updated, err }
 
-    if usernameAlreadyInUse(username) {
-        this.rwMutex.Unlock()
-        return nil
-    }
+    return true, RevokeResumeTokens(id) // so they won't work after unbanning
+}
 
-    userId := availableUserId()
-    if userId == nil {
-        this.rwMutex.Unlock()
-        return nil
-    }
-    utils.Assert(*userId > 0)
+func RevokeResumeTokens(id uint32) error { return this.SetUserTokensRevokedMillis(id, utils.CurrentTimeMillis()) }
+
+func SetLastSeen(id uint32, millis uint64) error { return this.SetUserLastSeenMillis(id, millis) }
 
-    result, err := this.users.InsertOne(*(this.ctx), User{Id: *userId, Name: username, Password: hashedPassword})
-    if result == nil || err != nil {
-        this.rwMutex.Unlock()
-        return nil
+func LoadResumeTokensKey() ([]byte, error) { return this.LoadOrStoreKey(keyResumeTokens, crypto.GenerateKey()) }
+
+func DeleteUser(user *User, unhashedPassword []byte) (bool, error) { // returns false if the password doesn't match; the user leaves all their rooms
+    utils.Assert(user != nil && len(unhashedPassword) > 0)
+
+    found, err := FindUser(user.Name, unhashedPassword)
+    if found == nil || err != nil || found.Id != user.Id { return false, err }
+
+    rooms, err := this.GetUserRooms(user.Id)
+    if err != nil { return false, err }
+
+    for i := range rooms {
+        if _, err = LeaveRoom(&(rooms[i]), user.Id); err != nil { return false, err }
     }
 
-    result2 := this.users.FindOne(*(this.ctx), bson.D{{fieldRealId, result.InsertedID}})
-    utils.Assert(result2.Err() == nil)
+    return this.DeleteUser(user.Id)
+}
 
-    user := new(User)
-    utils.Assert(result2.Decode(user) == nil)
-    utils.Assert(user.Id > 0 && reflect.DeepEqual(username, user.Name) && reflect.DeepEqual(hashedPassword, user.Password))
+func GetAllUsers() ([]User, error) { return this.GetAllUsers() }
 
-    this.rwMutex.Unlock()
-    return user
+func FindUsers(prefix []byte, ids []uint32, fromId uint32, limit uint32) ([]User, error) { // nillable ids
+    utils.Assert(len(prefix) <= len(adminUsername) && limit > 0)
+    if ids != nil && len(ids) == 0 { return []User{}, nil }
+    return this.FindUsers(prefix, ids, fromId, limit)
 }
 
-// TODO: DeleteUser(...)
+func GetUsersCount() (uint32, error) { return this.GetUsersCount() }
 
-func GetAllUsers() []User {
-    this.rwMutex.RLock()
-    cursor, err := this.users.Find(*(this.ctx), bson.D{})
-    this.rwMutex.RUnlock()
+func UserExists(id uint32) (bool, error) { return this.UserExists(id) }
+
+func GetMessagesFromOrForUser(from bool, id uint32, afterTimestamp uint64) ([]Message, error) {
+    return this.GetMessagesFromOrForUser(from, id, afterTimestamp)
+}
+
+func GetConversation(first uint32, second uint32, after MessageCursor, before MessageCursor, limit uint32, latest bool) ([]Message, error) {
+    utils.Assert(limit > 0)
+    if !after.precedes(before) { return []Message{}, nil }
+    return this.GetConversation(first, second, after, before, limit, latest)
+}
+
+func GetRoomMessages(room uint32, after MessageCursor, before MessageCursor, limit uint32, latest bool) ([]Message, error) {
+    utils.Assert(room > 0 && limit > 0)
+    if !after.precedes(before) { return []Message{}, nil }
+    return this.GetRoomMessages(room, after, before, limit, latest)
+}
+
+func AddMessage(id uint64, timestamp uint64, from uint32, to uint32, body []byte) error {
+    return this.AddMessage(Message{Id: id, Timestamp: timestamp, ReceivedMillis: utils.CurrentTimeMillis(), From: from, To: to, Room: 0, Body: body})
+}
+
+func AddRoomMessage(id uint64, timestamp uint64, from uint32, room uint32, body []byte) error { // the history record, the members' copies are queued via EnqueueRoomMessage with the same id
+    utils.Assert(room > 0)
+    return this.AddMessage(Message{Id: id, Timestamp: timestamp, ReceivedMillis: utils.CurrentTimeMillis(), From: from, To: roomMessageRecipient, Room: room, Body: body})
+}
+
+func PurgeMessages(first uint32, second *uint32 /*nillable*/) (uint64, error) { // the queued ones aren't touched as they haven't been delivered yet
+    count, err := this.DeleteMessages(first, second)
+    purgedMessages.Add("admin", count)
+    return count, err
+}
 
-    utils.Assert(err == nil)
+func EnqueueMessage(id uint64, timestamp uint64, from uint32, to uint32, body []byte) error {
+    return this.EnqueueMessage(Message{Id: id, Timestamp: timestamp, ReceivedMillis: utils.CurrentTimeMillis(), From: from, To: to, Room: 0, Body: body})
+}
 
-    var users []User
-    utils.Assert(cursor.All(*(this.ctx), &users) == nil && len(users) > 0)
-    return users
+func EnqueueRoomMessage(id uint64, timestamp uint64, from uint32, to uint32, room uint32, body []byte) error { // each member gets a copy with the same id
+    utils.Assert(room > 0)
+    return this.EnqueueMessage(Message{Id: id, Timestamp: timestamp, ReceivedMillis: utils.CurrentTimeMillis(), From: from, To: to, Room: room, Body: body})
 }
 
-func GetUsersCount() uint32 {
-    this.rwMutex.RLock()
-    count, err := this.users.EstimatedDocumentCount(*(this.ctx))
-    this.rwMutex.RUnlock()
+func GetQueuedMessages(to uint32) ([]Message, error) { return this.GetQueuedMessages(to) }
 
-    utils.Assert(err == nil)
-    return uint32(count)
+func DequeueMessage(to uint32, id uint64) (bool, error) { // returns true if the message was in the queue
+    return this.DequeueMessage(to, id)
 }
 
-func UserExists(id uint32) bool {
-    this.rwMutex.RLock()
-    result := this.users.FindOne(*(this.ctx), bson.D{{fieldId, id}})
-    this.rwMutex.RUnlock()
+func SetMessageStatus(to uint32, id uint64, status uint8) (*Message, error) { // nillable first result; only the recipient's messages are matched
+    utils.Assert(status == MessageDelivered || status == MessageRead)
+    return this.SetMessageStatus(to, id, status)
+}
 
-    return result.Err() == nil
+func EditMessage(from uint32, id uint64, body []byte) (*Message, error) { // nillable first result, nil if there's no such message or it has been deleted
+    utils.Assert(len(body) > 0)
+    return this.UpdateMessage(from, id, body, utils.CurrentTimeMillis())
 }
 
-func GetMessagesFromOrForUser(from bool, id uint32, afterTimestamp uint64) []Message {
-    var field string
-    if from { field = fieldFrom } else { field = fieldTo }
+func DeleteMessage(from uint32, id uint64) (*Message, error) { // nillable first result; leaves a tombstone, so the recipient learns about the deletion from the history, the undelivered copy is dropped
+    deleted, err := this.UpdateMessage(from, id, []byte{}, utils.CurrentTimeMillis())
+    if deleted == nil || err != nil { return nil, err }
 
-    this.rwMutex.RLock()
-    cursor, err := this.messages.Find(
-        *(this.ctx),
-        bson.M{field: id, fieldTimestamp: bson.M{"$gt": afterTimestamp}},
-        options.Find().SetSort(bson.D{{fieldTimestamp, 1}}),
-    )
-    this.rwMutex.RUnlock()
+    if deleted.Room == 0 {
+        _, err = this.DequeueMessage(deleted.To, id)
+        return deleted, err
+    }
 
-    utils.Assert(err == nil)
+    members, err := this.GetRoomMembers(deleted.Room)
+    for _, member := range members {
+        if err != nil { break }
+        _, err = this.DequeueMessage(member, id)
+    }
+    return deleted, err
+}
 
-    var messages []Message
-    utils.Assert(cursor.All(*(this.ctx), &messages) == nil)
-    return messages
+func CreateRoom(name []byte, owner uint32) (*Room, error) { // nillable first result; the owner becomes the first member
+    utils.Assert(len(name) > 0)
+
+    room, err := this.AddRoom(name, owner)
+    if room == nil || err != nil { return nil, err }
+
+    if _, err = this.AddRoomMember(room.Id, owner); err != nil { return nil, err }
+    return room, nil
 }
 
-func AddMessage(timestamp uint64, from uint32, to uint32, body []byte) bool {
-    this.rwMutex.Lock()
-    result, err := this.messages.InsertOne(*(this.ctx), Message{timestamp, from, to, body})
-    this.rwMutex.Unlock()
+func GetRoom(id uint32) (*Room, error) { return this.GetRoom(id) }
+
+func AddRoomMember(room uint32, user uint32) (bool, error) { return this.AddRoomMember(room, user) }
+
+func RemoveRoomMember(room uint32, user uint32) (bool, error) { return this.RemoveRoomMember(room, user) }
 
-    return result != nil && err == nil
+func GetRoomMembers(room uint32) ([]uint32, error) { return this.GetRoomMembers(room) }
+
+func GetUserRooms(user uint32) ([]Room, error) { return this.GetUserRooms(user) }
+
+func IsRoomMember(room uint32, user uint32) (bool, error) {
+    members, err := this.GetRoomMembers(room)
+    if err != nil { return false, err }
+
+    for _, member := range members {
+        if member == user { return true, nil }
+    }
+    return false, nil
 }
 
-func DeleteAllMessagesFromAllUsers() bool {
-    this.rwMutex.Lock()
-    result, err := this.messages.DeleteMany(*(this.ctx), bson.D{})
-    this.rwMutex.Unlock()
+func LeaveRoom(room *Room, user uint32) (bool, error) { // returns false if the user isn't a member; the room is deleted after its last member leaves, the ownership passes to another member if the owner leaves
+    utils.Assert(room != nil)
+
+    left, err := this.RemoveRoomMember(room.Id, user)
+    if !left || err != nil { return false, err }
+
+    members, err := this.GetRoomMembers(room.Id)
+    if err != nil { return true, err }
+
+    if len(members) == 0 {
+        err = this.DeleteRoom(room.Id)
+    } else if room.Owner == user {
+        err = this.SetRoomOwner(room.Id, members[0])
+    }
 
-    utils.Assert(err == nil)
-    return result.DeletedCount > 0
+    return true, err
 }
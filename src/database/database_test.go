@@ -0,0 +1,372 @@
+/*
+ * Exchatge - a secured realtime message exchanger (server).
+ * Copyright (C) 2023-2024  Vadim Nikolaev (https://github.com/vadniks)
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+
+package database
+
+import (
+    "ExchatgeServer/crypto"
+    "ExchatgeServer/utils"
+    "bytes"
+    "errors"
+    "sync/atomic"
+    "testing"
+    "time"
+)
+
+func TestMemoryStorageUsers(t *testing.T) {
+    Initialize(InitMemoryStorage(10), []byte{'a', 'd', 'm', 'i', 'n', 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0})
+
+    if count, err := GetUsersCount(); count != 3 || err != nil { t.Error() } // admin & 2 moc users
+    for i := uint32(0); i < 4; i++ {
+        if exists, err := UserExists(i); exists != (i < 3) || err != nil { t.Error() }
+    }
+
+    username := []byte{'u', 's', 'e', 'r', '3', 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+    password := []byte{'p', 'a', 's', 's', 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+    hashedPassword := crypto.Hash(password)
+
+    user, err := AddUser(username, hashedPassword)
+    if user == nil || err != nil || user.Id != 3 || !bytes.Equal(user.Name, username) { t.Error() }
+    if user, err = AddUser(username, hashedPassword); user != nil || err != nil { t.Error() } // username must be unique
+
+    if found, err := FindUser(username, password); found == nil || err != nil || found.Id != 3 { t.Error() }
+    if found, err := FindUser(username, []byte{'w', 'r', 'o', 'n', 'g'}); found != nil || err != nil { t.Error() }
+    if found, _ := FindUser(adminUsername, []byte{'a', 'd', 'm', 'i', 'n', 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}); found == nil { t.Error() }
+
+    if users, err := GetAllUsers(); len(users) != 4 || err != nil { t.Error() }
+
+    for i := 4; i < 10; i++ { _, _ = AddUser([]byte{'u', 's', 'e', 'r', byte('0' + i)}, hashedPassword) }
+    if count, _ := GetUsersCount(); count != 10 { t.Error() }
+    if user, err = AddUser([]byte{'u', 's', 'e', 'r', 'a'}, hashedPassword); user != nil || err != nil { t.Error() } // no ids left
+
+    Destroy()
+}
+
+func TestMemoryStorageUserSearch(t *testing.T) {
+    Initialize(InitMemoryStorage(10), []byte{'a', 'd', 'm', 'i', 'n', 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0})
+
+    _, _ = AddUser([]byte{'b', 'o', 'b', 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, crypto.Hash([]byte{'b', 'o', 'b'}))
+
+    if users, err := FindUsers(nil, nil, 0, 10); len(users) != 4 || err != nil || users[0].Id != 0 || users[3].Id != 3 { t.Error() }
+    if users, _ := FindUsers([]byte{'u', 's', 'e', 'r'}, nil, 0, 10); len(users) != 2 || users[0].Id != 1 || users[1].Id != 2 { t.Error() }
+    if users, _ := FindUsers([]byte{'u', 's', 'e', 'r', '2'}, nil, 0, 10); len(users) != 1 || users[0].Id != 2 { t.Error() }
+    if users, _ := FindUsers([]byte{'x'}, nil, 0, 10); len(users) != 0 { t.Error() }
+
+    if users, _ := FindUsers(nil, nil, 0, 2); len(users) != 2 || users[1].Id != 1 { t.Error() } // first page
+    if users, _ := FindUsers(nil, nil, 2, 2); len(users) != 2 || users[0].Id != 2 || users[1].Id != 3 { t.Error() } // second page
+    if users, _ := FindUsers(nil, nil, 4, 2); len(users) != 0 { t.Error() } // no more pages
+
+    if users, _ := FindUsers(nil, []uint32{3, 1}, 0, 10); len(users) != 2 || users[0].Id != 1 || users[1].Id != 3 { t.Error() }
+    if users, _ := FindUsers([]byte{'b'}, []uint32{1}, 0, 10); len(users) != 0 { t.Error() }
+    if users, _ := FindUsers(nil, []uint32{}, 0, 10); len(users) != 0 { t.Error() }
+
+    Destroy()
+}
+
+func TestMemoryStorageMessages(t *testing.T) {
+    Initialize(InitMemoryStorage(10), []byte{'a', 'd', 'm', 'i', 'n', 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0})
+
+    _ = AddMessage(0, 3, 1, 2, []byte{3})
+    _ = AddMessage(0, 1, 1, 2, []byte{1})
+    _ = AddMessage(0, 2, 2, 1, []byte{2})
+
+    messages, err := GetMessagesFromOrForUser(true, 1, 0)
+    if len(messages) != 2 || err != nil || messages[0].Timestamp != 1 || messages[1].Timestamp != 3 { t.Error() }
+
+    messages, _ = GetMessagesFromOrForUser(false, 1, 0)
+    if len(messages) != 1 || messages[0].From != 2 || !bytes.Equal(messages[0].Body, []byte{2}) { t.Error() }
+
+    if messages, _ = GetMessagesFromOrForUser(true, 1, 1); len(messages) != 1 { t.Error() }
+
+    if deleted, err := PurgeMessages(1, nil); deleted != 3 || err != nil { t.Error() }
+    if messages, _ = GetMessagesFromOrForUser(true, 1, 0); len(messages) != 0 { t.Error() }
+
+    _ = EnqueueMessage(2, 2, 1, 2, []byte{2})
+    _ = EnqueueMessage(1, 1, 1, 2, []byte{1})
+    _ = EnqueueMessage(3, 1, 2, 1, []byte{1})
+
+    queued, err := GetQueuedMessages(2)
+    if len(queued) != 2 || err != nil || queued[0].Timestamp != 1 || queued[1].Timestamp != 2 { t.Error() }
+
+    if dequeued, _ := DequeueMessage(2, 1); !dequeued { t.Error() }
+    if dequeued, _ := DequeueMessage(2, 1); dequeued { t.Error() }
+
+    if queued, _ = GetQueuedMessages(2); len(queued) != 1 { t.Error() }
+    if queued, _ = GetQueuedMessages(1); len(queued) != 1 { t.Error() }
+
+    Destroy()
+}
+
+func TestMessageQueue(t *testing.T) {
+    Initialize(InitMemoryStorage(10), []byte{'a', 'd', 'm', 'i', 'n', 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0})
+
+    _ = EnqueueMessage(1, 1, 1, 2, []byte{1})
+    _ = EnqueueMessage(2, 1, 1, 2, []byte{2}) // the same millisecond
+    _ = EnqueueMessage(3, 1, 2, 1, []byte{3})
+
+    if dequeued, err := DequeueMessage(2, 2); !dequeued || err != nil { t.Error() }
+    if queued, _ := GetQueuedMessages(2); len(queued) != 1 || !bytes.Equal(queued[0].Body, []byte{1}) { t.Error() }
+
+    if dequeued, _ := DequeueMessage(2, 1); !dequeued { t.Error() }
+    if dequeued, _ := DequeueMessage(2, 1); dequeued { t.Error() }
+    if dequeued, _ := DequeueMessage(2, 3); dequeued { t.Error() } // another recipient's
+
+    if queued, _ := GetQueuedMessages(2); len(queued) != 0 { t.Error() }
+    if queued, _ := GetQueuedMessages(1); len(queued) != 1 { t.Error() }
+
+    Destroy()
+}
+
+func TestMemoryStorageConversation(t *testing.T) {
+    Initialize(InitMemoryStorage(10), []byte{'a', 'd', 'm', 'i', 'n', 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0})
+
+    for i := uint64(1); i <= 6; i++ {
+        if i % 2 == 1 { _ = AddMessage(i, i, 1, 2, []byte{byte(i)}) } else { _ = AddMessage(i, i, 2, 1, []byte{byte(i)}) }
+    }
+    _ = AddMessage(7, 7, 1, 0, []byte{7}) // another conversation
+
+    unbounded := MessageCursor{100, 0}
+    if messages, err := GetConversation(1, 2, MessageCursor{}, unbounded, 10, true); len(messages) != 6 || err != nil || messages[0].Timestamp != 1 || messages[5].Timestamp != 6 { t.Error() }
+    if messages, _ := GetConversation(2, 1, MessageCursor{}, unbounded, 2, true); len(messages) != 2 || messages[0].Timestamp != 5 || messages[1].Timestamp != 6 { t.Error() } // the latest page
+    if messages, _ := GetConversation(1, 2, MessageCursor{}, MessageCursor{5, 5}, 2, true); len(messages) != 2 || messages[0].Timestamp != 3 || messages[1].Timestamp != 4 { t.Error() } // scrolling back
+    if messages, _ := GetConversation(1, 2, MessageCursor{2, 2}, unbounded, 2, false); len(messages) != 2 || messages[0].Timestamp != 3 || messages[1].Timestamp != 4 { t.Error() } // scrolling forward
+    if messages, _ := GetConversation(1, 2, MessageCursor{6, 6}, unbounded, 2, false); len(messages) != 0 { t.Error() }
+    if messages, _ := GetConversation(1, 2, MessageCursor{3, 3}, MessageCursor{3, 3}, 2, false); len(messages) != 0 { t.Error() }
+
+    _ = AddMessage(9, 8, 1, 2, []byte{9}) // stored out of order, within the same millisecond
+    _ = AddMessage(8, 8, 2, 1, []byte{8})
+
+    if messages, _ := GetConversation(1, 2, MessageCursor{6, 6}, unbounded, 1, false); len(messages) != 1 || messages[0].Id != 8 { t.Error() }
+    if messages, _ := GetConversation(1, 2, MessageCursor{8, 8}, unbounded, 1, false); len(messages) != 1 || messages[0].Id != 9 { t.Error() } // the rest of the millisecond isn't skipped
+    if messages, _ := GetConversation(1, 2, MessageCursor{}, MessageCursor{8, 9}, 1, true); len(messages) != 1 || messages[0].Id != 8 { t.Error() }
+
+    Destroy()
+}
+
+func TestMessageChanges(t *testing.T) {
+    Initialize(InitMemoryStorage(10), []byte{'a', 'd', 'm', 'i', 'n', 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0})
+
+    _ = AddMessage(1, 1, 1, 2, []byte{1})
+    _ = EnqueueMessage(1, 1, 1, 2, []byte{1})
+    _ = AddMessage(2, 1, 1, 2, []byte{2}) // the same timestamp
+    _ = EnqueueMessage(2, 1, 1, 2, []byte{2})
+
+    if edited, err := EditMessage(2, 1, []byte{3}); edited != nil || err != nil { t.Error() } // only the sender can
+    if edited, err := EditMessage(1, 1, []byte{3}); edited == nil || edited.To != 2 || !bytes.Equal(edited.Body, []byte{1}) || err != nil { t.Error() }
+    if deleted, err := DeleteMessage(1, 2); deleted == nil || deleted.Id != 2 || err != nil { t.Error() }
+    if edited, _ := EditMessage(1, 2, []byte{4}); edited != nil { t.Error() } // tombstones stay
+    if edited, _ := EditMessage(1, 3, []byte{4}); edited != nil { t.Error() } // no such message
+
+    messages, _ := GetConversation(1, 2, MessageCursor{}, MessageCursor{100, 0}, 10, false)
+    if len(messages) != 2 || !bytes.Equal(messages[0].Body, []byte{3}) || messages[0].EditedMillis == 0 || messages[0].Deleted { t.Error() }
+    if len(messages[1].Body) != 0 || !messages[1].Deleted { t.Error() }
+
+    if queued, _ := GetQueuedMessages(2); len(queued) != 1 || !bytes.Equal(queued[0].Body, []byte{3}) { t.Error() } // the deleted one won't be delivered
+
+    Destroy()
+}
+
+func TestMessageStatus(t *testing.T) {
+    Initialize(InitMemoryStorage(10), []byte{'a', 'd', 'm', 'i', 'n', 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0})
+
+    _ = AddMessage(1, 1, 1, 2, []byte{1})
+    _ = AddMessage(2, 1, 1, 2, []byte{2}) // the same timestamp
+
+    if changed, err := SetMessageStatus(2, 1, MessageRead); changed == nil || changed.From != 1 || changed.Status != MessageStored || err != nil { t.Error() }
+    if changed, _ := SetMessageStatus(2, 1, MessageDelivered); changed != nil { t.Error() } // never goes down
+    if changed, _ := SetMessageStatus(1, 2, MessageDelivered); changed != nil { t.Error() } // only the recipient's messages
+    if changed, _ := SetMessageStatus(2, 3, MessageDelivered); changed != nil { t.Error() } // no such message
+
+    if messages, _ := GetConversation(1, 2, MessageCursor{}, MessageCursor{100, 0}, 10, false); len(messages) != 2 || messages[0].Status != MessageRead || messages[1].Status != MessageStored { t.Error() }
+
+    Destroy()
+}
+
+func TestMessageIds(t *testing.T) {
+    ids := &messageIdsT{machine: 5}
+
+    first := ids.next(10)
+    if first >> (messageIdMachineBits + messageIdSequenceBits) != 10 || (first >> messageIdSequenceBits) & messageIdMachineMask != 5 { t.Error() }
+
+    previous := first
+    for i := 0; i < messageIdSequenceMask + 2; i++ { // exhausts the sequence so the next millisecond is borrowed
+        id := ids.next(10)
+        if id <= previous { t.Error() }
+        previous = id
+    }
+    if previous >> (messageIdMachineBits + messageIdSequenceBits) != 11 { t.Error() }
+
+    if id := ids.next(3); id <= previous { t.Error() } // the clock went backwards
+
+    if machineBits([]byte("0123456789abcdef0123456789abcdef")) == machineBits([]byte("1023456789abcdef0123456789abcdef")) { t.Error() } // the same bytes in another order, which a xor fold doesn't tell apart
+    if machineBits(nil) > messageIdMachineMask { t.Error() }
+
+    Initialize(InitMemoryStorage(10), []byte{'a', 'd', 'm', 'i', 'n', 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0})
+
+    id := NextMessageId()
+    _ = AddMessage(id, 1, 1, 2, []byte{1})
+    _ = EnqueueMessage(id, 1, 1, 2, []byte{1})
+
+    if messages, _ := GetConversation(1, 2, MessageCursor{}, MessageCursor{100, 0}, 10, false); len(messages) != 1 || messages[0].Id != id { t.Error() }
+    if queued, _ := GetQueuedMessages(2); len(queued) != 1 || queued[0].Id != id { t.Error() }
+
+    Destroy()
+}
+
+func TestRetention(t *testing.T) {
+    Initialize(InitMemoryStorage(10), []byte{'a', 'd', 'm', 'i', 'n', 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0})
+
+    now := utils.CurrentTimeMillis()
+    received := func(timestamp uint64, receivedMillis uint64, from uint32, to uint32) { _ = this.AddMessage(Message{Timestamp: timestamp, ReceivedMillis: receivedMillis, From: from, To: to, Body: []byte{1}}) }
+
+    received(now + 100000, now - 5000, 1, 2) // expired, whatever the sender's timestamp is
+    for i := uint64(0); i < 4; i++ { received(now - 100 + i, now - 100 + i, 1, 2) }
+    received(0, now - 50, 2, 1) // isn't expired
+    received(now - 40, now - 40, 2, 0)
+
+    if deleted, err := Purge(Retention{MaxAgeMillis: 1000, MaxPerSender: 0}); deleted != 1 || err != nil { t.Error() }
+    if deleted, err := Purge(Retention{MaxAgeMillis: 0, MaxPerSender: 2}); deleted != 2 || err != nil { t.Error() }
+
+    messages, _ := GetMessagesFromOrForUser(true, 1, 0)
+    if len(messages) != 2 || messages[0].Timestamp != now - 98 || messages[1].Timestamp != now - 97 { t.Error() } // the latest ones are kept
+
+    _ = AddMessage(0, 1, 3, 1, []byte{1})
+    if messages, _ = GetMessagesFromOrForUser(true, 3, 0); len(messages) != 1 || messages[0].ReceivedMillis < now { t.Error() }
+
+    second := uint32(1)
+    if deleted, _ := PurgeMessages(2, &second); deleted != 3 { t.Error() } // the conversation only
+    if messages, _ = GetMessagesFromOrForUser(true, 2, 0); len(messages) != 1 || messages[0].To != 0 { t.Error() }
+
+    Destroy()
+}
+
+func TestMemoryStorageRooms(t *testing.T) {
+    Initialize(InitMemoryStorage(10), []byte{'a', 'd', 'm', 'i', 'n', 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0})
+
+    room, err := CreateRoom([]byte{'r', 'o', 'o', 'm'}, 1)
+    if room == nil || err != nil || room.Id == 0 || room.Owner != 1 { t.Error() } // 0 is reserved for direct messages
+    if member, _ := IsRoomMember(room.Id, 1); !member { t.Error() }
+
+    if added, err := AddRoomMember(room.Id, 2); !added || err != nil { t.Error() }
+    if added, _ := AddRoomMember(room.Id, 2); added { t.Error() }
+    if members, _ := GetRoomMembers(room.Id); len(members) != 2 { t.Error() }
+    if rooms, _ := GetUserRooms(2); len(rooms) != 1 || rooms[0].Id != room.Id { t.Error() }
+
+    _, _ = AddRoomMember(room.Id, 3)
+    _ = AddRoomMessage(1, 1, 1, room.Id, []byte{1})
+    _ = EnqueueRoomMessage(1, 1, 1, 2, room.Id, []byte{1})
+    _ = EnqueueRoomMessage(1, 1, 1, 3, room.Id, []byte{1})
+    if queued, _ := GetQueuedMessages(2); len(queued) != 1 || queued[0].Room != room.Id || queued[0].Id != 1 { t.Error() }
+
+    if messages, err := GetRoomMessages(room.Id, MessageCursor{}, MessageCursor{100, 0}, 10, true); len(messages) != 1 || err != nil || messages[0].From != 1 { t.Error() } // stored once
+    if messages, _ := GetConversation(1, 2, MessageCursor{}, MessageCursor{100, 0}, 10, true); len(messages) != 0 { t.Error() } // not a direct message
+    if messages, _ := GetMessagesFromOrForUser(true, 1, 0); len(messages) != 0 { t.Error() }
+
+    if edited, _ := EditMessage(1, 1, []byte{2}); edited == nil || edited.Room != room.Id { t.Error() }
+    if queued, _ := GetQueuedMessages(3); len(queued) != 1 || !bytes.Equal(queued[0].Body, []byte{2}) { t.Error() } // every member's copy
+    if deleted, _ := DeleteMessage(1, 1); deleted == nil { t.Error() }
+    if queued, _ := GetQueuedMessages(2); len(queued) != 0 { t.Error() }
+    if queued, _ := GetQueuedMessages(3); len(queued) != 0 { t.Error() }
+    if messages, _ := GetRoomMessages(room.Id, MessageCursor{}, MessageCursor{100, 0}, 10, true); len(messages) != 1 || !messages[0].Deleted { t.Error() }
+    _, _ = LeaveRoom(room, 3)
+
+    if left, err := LeaveRoom(room, 1); !left || err != nil { t.Error() }
+    if room, _ = GetRoom(room.Id); room == nil || room.Owner != 2 { t.Error() } // the ownership passes to the remaining member
+
+    if left, _ := LeaveRoom(room, 2); !left { t.Error() }
+    if room, _ = GetRoom(room.Id); room != nil { t.Error() } // deleted along with its last member
+    if rooms, _ := GetUserRooms(2); len(rooms) != 0 { t.Error() }
+
+    Destroy()
+}
+
+func TestMemoryStorageAccounts(t *testing.T) {
+    Initialize(InitMemoryStorage(10), []byte{'a', 'd', 'm', 'i', 'n', 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0})
+
+    password := []byte{'u', 's', 'e', 'r', '1', 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+    newPassword := []byte{'p', 'a', 's', 's', 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+    user, _ := FindUser([]byte{'u', 's', 'e', 'r', '1', 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, password)
+
+    if changed, err := ChangePassword(user, newPassword, crypto.Hash(newPassword)); changed || err != nil { t.Error() } // wrong old password
+    if changed, err := ChangePassword(user, password, crypto.Hash(newPassword)); !changed || err != nil { t.Error() }
+    if found, _ := FindUser(user.Name, newPassword); found == nil { t.Error() }
+
+    if renamed, _ := RenameUser(user.Id, []byte{'u', 's', 'e', 'r', '2', 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}); renamed { t.Error() } // must be unique
+    username := []byte{'r', 'e', 'n', 'a', 'm', 'e', 'd', 0, 0, 0, 0, 0, 0, 0, 0, 0}
+    if renamed, err := RenameUser(user.Id, username); !renamed || err != nil { t.Error() }
+    user.Name = username
+
+    room, _ := CreateRoom([]byte{'r', 'o', 'o', 'm'}, user.Id)
+    _, _ = AddRoomMember(room.Id, 2)
+    _ = AddMessage(0, 1, user.Id, 2, []byte{1})
+    _ = EnqueueMessage(0, 1, user.Id, 2, []byte{1})
+
+    if deleted, _ := DeleteUser(user, password); deleted { t.Error() } // the old password doesn't work anymore
+    deletedMillis := utils.CurrentTimeMillis()
+    if deleted, err := DeleteUser(user, newPassword); !deleted || err != nil { t.Error() }
+
+    if exists, _ := UserExists(user.Id); exists { t.Error() }
+    if messages, _ := GetMessagesFromOrForUser(false, 2, 0); len(messages) != 0 { t.Error() }
+    if queued, _ := GetQueuedMessages(2); len(queued) != 0 { t.Error() }
+    if room, _ = GetRoom(room.Id); room == nil || room.Owner != 2 { t.Error() }
+
+    if added, _ := AddUser(username, crypto.Hash(newPassword)); added == nil || added.Id != user.Id { t.Error() } // the id has been returned to the pool
+    if found, _ := FindUserById(user.Id); found == nil || found.TokensRevokedMillis < deletedMillis { t.Error() } // the deleted user's resume tokens don't work for the new one
+
+    if banned, _ := SetUserBanned(0, true); banned { t.Error() } // the admin can't be banned
+    if banned, err := SetUserBanned(2, true); !banned || err != nil { t.Error() }
+    if found, _ := FindUser([]byte{'u', 's', 'e', 'r', '2', 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, []byte{'u', 's', 'e', 'r', '2', 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}); found == nil || !found.Banned { t.Error() }
+
+    if err := SetLastSeen(2, 5); err != nil { t.Error() }
+    if found, _ := FindUserById(2); found == nil || found.LastSeenMillis != 5 { t.Error() }
+
+    Destroy()
+}
+
+type unreachableStorage struct {
+    *memoryStorage
+    unreachable atomic.Bool
+}
+
+func (storage *unreachableStorage) Ping() error {
+    if storage.unreachable.Load() { return errors.New("unreachable") } else { return nil }
+}
+
+func TestMonitor(t *testing.T) {
+    storage := &unreachableStorage{InitMemoryStorage(10).(*memoryStorage), atomic.Bool{}}
+    Initialize(storage, []byte{'a', 'd', 'm', 'i', 'n', 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0})
+    Monitor(10)
+
+    waitFor := func(available bool) bool {
+        for i := 0; i < 100 && Available() != available; i++ { time.Sleep(5 * time.Millisecond) }
+        return Available() == available
+    }
+
+    if !waitFor(true) { t.Error() }
+
+    storage.unreachable.Store(true)
+    if !waitFor(false) { t.Error() }
+
+    storage.unreachable.Store(false)
+    if !waitFor(true) { t.Error() }
+
+    storage.unreachable.Store(true)
+    Destroy()
+    if !Available() { t.Error() } // the monitor has been halted
+}
@@ -0,0 +1,71 @@
+/*
+ * Exchatge - a secured realtime message exchanger (server).
+ * Copyright (C) 2023-2024  Vadim Nikolaev (https://github.com/vadniks)
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+
+package database
+
+import (
+    "ExchatgeServer/utils"
+    "crypto/rand"
+    "hash/fnv"
+    "sync"
+)
+
+const (
+    messageIdMachineBits = 10
+    messageIdSequenceBits = 12 // up to 4096 ids per millisecond, the clock is borrowed from the future beyond that
+    messageIdMachineMask = 1 << messageIdMachineBits - 1
+    messageIdSequenceMask = 1 << messageIdSequenceBits - 1
+)
+
+type messageIdsT struct { // generates ids ordered by the generation time: milliseconds (42 bits), machine (10 bits), sequence (12 bits)
+    mutex sync.Mutex
+    machine uint64
+    lastMillis uint64
+    sequence uint64
+}
+
+var messageIds = &messageIdsT{sync.Mutex{}, machineBits(utils.MachineIdBytes()), 0, 0} // aka singleton
+
+func machineBits(machineId []byte /*nillable*/) uint64 { // spreads machines' ids over the machine bits, a random value is taken if there's no machine id
+    if machineId == nil {
+        machineId = make([]byte, 16)
+        _, _ = rand.Read(machineId)
+    }
+
+    hash := fnv.New64a()
+    _, _ = hash.Write(machineId)
+    return hash.Sum64() & messageIdMachineMask
+}
+
+func (messageIds *messageIdsT) next(now uint64) uint64 {
+    messageIds.mutex.Lock()
+
+    if now > messageIds.lastMillis {
+        messageIds.lastMillis, messageIds.sequence = now, 0
+    } else {
+        messageIds.sequence = (messageIds.sequence + 1) & messageIdSequenceMask
+        if messageIds.sequence == 0 { messageIds.lastMillis++ } // as the clock can also go backwards, the ids keep growing anyway
+    }
+
+    id := messageIds.lastMillis << (messageIdMachineBits + messageIdSequenceBits) | messageIds.machine << messageIdSequenceBits | messageIds.sequence
+    messageIds.mutex.Unlock()
+    return id
+}
+
+func NextMessageId() uint64 { return messageIds.next(utils.CurrentTimeMillis()) } // globally unique as long as the machines' ids differ
@@ -0,0 +1,296 @@
+/*
+ * Exchatge - a secured realtime message exchanger (server).
+ * Copyright (C) 2023-2024  Vadim Nikolaev (https://github.com/vadniks)
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+
+package database
+
+import (
+    xIdsPool "ExchatgeServer/idsPool"
+    "ExchatgeServer/logging"
+    "ExchatgeServer/metrics"
+    "time"
+)
+
+var databaseLatency = metrics.NewLatencyHistogram("exchatge_database_call_duration_seconds", "Duration of storage calls", "call")
+
+type instrumentedStorage struct { // measures latency of each call of the wrapped storage & logs failures
+    wrapped Storage
+}
+
+func (_ *instrumentedStorage) observe(call string, started time.Time, err error /*nillable*/) {
+    databaseLatency.Observe(call, started)
+    if err == nil { return }
+
+    logging.Error("database call failed", logging.F("call", call), logging.Err(err))
+    monitor.suspect() // don't wait for the next scheduled check
+}
+
+func (storage *instrumentedStorage) Destroy() { storage.wrapped.Destroy() }
+
+func (storage *instrumentedStorage) GetIdsPools() (*xIdsPool.IdsPool, *xIdsPool.IdsPool) { return storage.wrapped.GetIdsPools() }
+
+func (storage *instrumentedStorage) Ping() error { // isn't observed as the monitor logs its failures itself
+    started := time.Now()
+    err := storage.wrapped.Ping()
+    databaseLatency.Observe("Ping", started)
+    return err
+}
+
+func (storage *instrumentedStorage) AddAdminIfNotExists(username []byte, hashedPassword []byte) {
+    started := time.Now()
+    storage.wrapped.AddAdminIfNotExists(username, hashedPassword)
+    storage.observe("AddAdminIfNotExists", started, nil)
+}
+
+func (storage *instrumentedStorage) FindUserByName(username []byte) (*User, error) {
+    started := time.Now()
+    result, err := storage.wrapped.FindUserByName(username)
+    storage.observe("FindUserByName", started, err)
+    return result, err
+}
+
+func (storage *instrumentedStorage) FindUserById(id uint32) (*User, error) {
+    started := time.Now()
+    result, err := storage.wrapped.FindUserById(id)
+    storage.observe("FindUserById", started, err)
+    return result, err
+}
+
+func (storage *instrumentedStorage) AddUser(username []byte, hashedPassword []byte) (*User, error) {
+    started := time.Now()
+    result, err := storage.wrapped.AddUser(username, hashedPassword)
+    storage.observe("AddUser", started, err)
+    return result, err
+}
+
+func (storage *instrumentedStorage) GetAllUsers() ([]User, error) {
+    started := time.Now()
+    result, err := storage.wrapped.GetAllUsers()
+    storage.observe("GetAllUsers", started, err)
+    return result, err
+}
+
+func (storage *instrumentedStorage) FindUsers(prefix []byte, ids []uint32, fromId uint32, limit uint32) ([]User, error) {
+    started := time.Now()
+    result, err := storage.wrapped.FindUsers(prefix, ids, fromId, limit)
+    storage.observe("FindUsers", started, err)
+    return result, err
+}
+
+func (storage *instrumentedStorage) GetUsersCount() (uint32, error) {
+    started := time.Now()
+    result, err := storage.wrapped.GetUsersCount()
+    storage.observe("GetUsersCount", started, err)
+    return result, err
+}
+
+func (storage *instrumentedStorage) UserExists(id uint32) (bool, error) {
+    started := time.Now()
+    result, err := storage.wrapped.UserExists(id)
+    storage.observe("UserExists", started, err)
+    return result, err
+}
+
+func (storage *instrumentedStorage) SetUserPassword(id uint32, hashedPassword []byte) error {
+    started := time.Now()
+    err := storage.wrapped.SetUserPassword(id, hashedPassword)
+    storage.observe("SetUserPassword", started, err)
+    return err
+}
+
+func (storage *instrumentedStorage) SetUserName(id uint32, username []byte) (bool, error) {
+    started := time.Now()
+    result, err := storage.wrapped.SetUserName(id, username)
+    storage.observe("SetUserName", started, err)
+    return result, err
+}
+
+func (storage *instrumentedStorage) SetUserBanned(id uint32, banned bool) (bool, error) {
+    started := time.Now()
+    result, err := storage.wrapped.SetUserBanned(id, banned)
+    storage.observe("SetUserBanned", started, err)
+    return result, err
+}
+
+func (storage *instrumentedStorage) SetUserTokensRevokedMillis(id uint32, millis uint64) error {
+    started := time.Now()
+    err := storage.wrapped.SetUserTokensRevokedMillis(id, millis)
+    storage.observe("SetUserTokensRevokedMillis", started, err)
+    return err
+}
+
+func (storage *instrumentedStorage) SetUserLastSeenMillis(id uint32, millis uint64) error {
+    started := time.Now()
+    err := storage.wrapped.SetUserLastSeenMillis(id, millis)
+    storage.observe("SetUserLastSeenMillis", started, err)
+    return err
+}
+
+func (storage *instrumentedStorage) DeleteUser(id uint32) (bool, error) {
+    started := time.Now()
+    result, err := storage.wrapped.DeleteUser(id)
+    storage.observe("DeleteUser", started, err)
+    return result, err
+}
+
+func (storage *instrumentedStorage) GetMessagesFromOrForUser(from bool, id uint32, afterTimestamp uint64) ([]Message, error) {
+    started := time.Now()
+    result, err := storage.wrapped.GetMessagesFromOrForUser(from, id, afterTimestamp)
+    storage.observe("GetMessagesFromOrForUser", started, err)
+    return result, err
+}
+
+func (storage *instrumentedStorage) GetConversation(first uint32, second uint32, after MessageCursor, before MessageCursor, limit uint32, latest bool) ([]Message, error) {
+    started := time.Now()
+    result, err := storage.wrapped.GetConversation(first, second, after, before, limit, latest)
+    storage.observe("GetConversation", started, err)
+    return result, err
+}
+
+func (storage *instrumentedStorage) GetRoomMessages(room uint32, after MessageCursor, before MessageCursor, limit uint32, latest bool) ([]Message, error) {
+    started := time.Now()
+    result, err := storage.wrapped.GetRoomMessages(room, after, before, limit, latest)
+    storage.observe("GetRoomMessages", started, err)
+    return result, err
+}
+
+func (storage *instrumentedStorage) AddMessage(message Message) error {
+    started := time.Now()
+    err := storage.wrapped.AddMessage(message)
+    storage.observe("AddMessage", started, err)
+    return err
+}
+
+func (storage *instrumentedStorage) DeleteMessagesBefore(receivedMillis uint64) (uint64, error) {
+    started := time.Now()
+    result, err := storage.wrapped.DeleteMessagesBefore(receivedMillis)
+    storage.observe("DeleteMessagesBefore", started, err)
+    return result, err
+}
+
+func (storage *instrumentedStorage) TrimMessages(maxPerSender uint32) (uint64, error) {
+    started := time.Now()
+    result, err := storage.wrapped.TrimMessages(maxPerSender)
+    storage.observe("TrimMessages", started, err)
+    return result, err
+}
+
+func (storage *instrumentedStorage) DeleteMessages(first uint32, second *uint32) (uint64, error) {
+    started := time.Now()
+    result, err := storage.wrapped.DeleteMessages(first, second)
+    storage.observe("DeleteMessages", started, err)
+    return result, err
+}
+
+func (storage *instrumentedStorage) EnqueueMessage(message Message) error {
+    started := time.Now()
+    err := storage.wrapped.EnqueueMessage(message)
+    storage.observe("EnqueueMessage", started, err)
+    return err
+}
+
+func (storage *instrumentedStorage) GetQueuedMessages(to uint32) ([]Message, error) {
+    started := time.Now()
+    result, err := storage.wrapped.GetQueuedMessages(to)
+    storage.observe("GetQueuedMessages", started, err)
+    return result, err
+}
+
+func (storage *instrumentedStorage) SetMessageStatus(to uint32, id uint64, status uint8) (*Message, error) {
+    started := time.Now()
+    result, err := storage.wrapped.SetMessageStatus(to, id, status)
+    storage.observe("SetMessageStatus", started, err)
+    return result, err
+}
+
+func (storage *instrumentedStorage) UpdateMessage(from uint32, id uint64, body []byte, editedMillis uint64) (*Message, error) {
+    started := time.Now()
+    result, err := storage.wrapped.UpdateMessage(from, id, body, editedMillis)
+    storage.observe("UpdateMessage", started, err)
+    return result, err
+}
+
+func (storage *instrumentedStorage) DequeueMessage(to uint32, id uint64) (bool, error) {
+    started := time.Now()
+    result, err := storage.wrapped.DequeueMessage(to, id)
+    storage.observe("DequeueMessage", started, err)
+    return result, err
+}
+
+func (storage *instrumentedStorage) AddRoom(name []byte, owner uint32) (*Room, error) {
+    started := time.Now()
+    result, err := storage.wrapped.AddRoom(name, owner)
+    storage.observe("AddRoom", started, err)
+    return result, err
+}
+
+func (storage *instrumentedStorage) GetRoom(id uint32) (*Room, error) {
+    started := time.Now()
+    result, err := storage.wrapped.GetRoom(id)
+    storage.observe("GetRoom", started, err)
+    return result, err
+}
+
+func (storage *instrumentedStorage) SetRoomOwner(id uint32, owner uint32) error {
+    started := time.Now()
+    err := storage.wrapped.SetRoomOwner(id, owner)
+    storage.observe("SetRoomOwner", started, err)
+    return err
+}
+
+func (storage *instrumentedStorage) DeleteRoom(id uint32) error {
+    started := time.Now()
+    err := storage.wrapped.DeleteRoom(id)
+    storage.observe("DeleteRoom", started, err)
+    return err
+}
+
+func (storage *instrumentedStorage) AddRoomMember(room uint32, user uint32) (bool, error) {
+    started := time.Now()
+    result, err := storage.wrapped.AddRoomMember(room, user)
+    storage.observe("AddRoomMember", started, err)
+    return result, err
+}
+
+func (storage *instrumentedStorage) RemoveRoomMember(room uint32, user uint32) (bool, error) {
+    started := time.Now()
+    result, err := storage.wrapped.RemoveRoomMember(room, user)
+    storage.observe("RemoveRoomMember", started, err)
+    return result, err
+}
+
+func (storage *instrumentedStorage) GetRoomMembers(room uint32) ([]uint32, error) {
+    started := time.Now()
+    result, err := storage.wrapped.GetRoomMembers(room)
+    storage.observe("GetRoomMembers", started, err)
+    return result, err
+}
+
+func (storage *instrumentedStorage) GetUserRooms(user uint32) ([]Room, error) {
+    started := time.Now()
+    result, err := storage.wrapped.GetUserRooms(user)
+    storage.observe("GetUserRooms", started, err)
+    return result, err
+}
+
+func (storage *instrumentedStorage) LoadOrStoreKey(name string, key []byte) ([]byte, error) {
+    started := time.Now()
+    result, err := storage.wrapped.LoadOrStoreKey(name, key)
+    storage.observe("LoadOrStoreKey", started, err)
+    return result, err
+}
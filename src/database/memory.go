@@ -0,0 +1,556 @@
+/*
+ * Exchatge - a secured realtime message exchanger (server).
+ * Copyright (C) 2023-2024  Vadim Nikolaev (https://github.com/vadniks)
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+
+package database
+
+import (
+    xIdsPool "ExchatgeServer/idsPool"
+    "ExchatgeServer/utils"
+    xBytes "bytes"
+    "sort"
+    "sync"
+)
+
+type memoryStorage struct { // keeps everything in the process' memory, so everything is lost on exit; intended for tests and local development
+    users []User
+    messages []Message
+    queue []Message
+    rooms []Room
+    memberships []Membership
+    keys map[string][]byte
+    idsPool *xIdsPool.IdsPool
+    roomIdsPool *xIdsPool.IdsPool
+    rwMutex sync.RWMutex
+}
+
+func InitMemoryStorage(maxUsersCount uint32) Storage {
+    storage := &memoryStorage{
+        make([]User, 0),
+        make([]Message, 0),
+        make([]Message, 0),
+        make([]Room, 0),
+        make([]Membership, 0),
+        make(map[string][]byte),
+        xIdsPool.InitIdsPool(maxUsersCount),
+        xIdsPool.InitIdsPool(maxRoomsCount),
+        sync.RWMutex{},
+    }
+
+    storage.roomIdsPool.SetId(0, true) // 0 means there's no room
+    return storage
+}
+
+func (_ *memoryStorage) Ping() error { return nil }
+
+func (storage *memoryStorage) Destroy() {
+    storage.rwMutex.Lock()
+    storage.users = nil
+    storage.messages = nil
+    storage.queue = nil
+    storage.rooms = nil
+    storage.memberships = nil
+    storage.keys = nil
+    storage.rwMutex.Unlock()
+}
+
+func (storage *memoryStorage) findUser(predicate func(user *User) bool) *User { // nillable result
+    for i := range storage.users {
+        if predicate(&(storage.users[i])) { return &(storage.users[i]) }
+    }
+    return nil
+}
+
+func (storage *memoryStorage) AddAdminIfNotExists(username []byte, hashedPassword []byte) {
+    storage.rwMutex.Lock()
+
+    if storage.findUser(func(user *User) bool { return user.Id == 0 }) == nil {
+        storage.users = append(storage.users, User{Id: 0, Name: username, Password: hashedPassword})
+    }
+
+    storage.idsPool.SetId(0, true)
+    storage.rwMutex.Unlock()
+}
+
+func (storage *memoryStorage) FindUserByName(username []byte) (*User, error) { // nillable first result
+    storage.rwMutex.RLock()
+    user := storage.findUser(func(user *User) bool { return xBytes.Equal(user.Name, username) })
+
+    var xUser *User = nil
+    if user != nil { xUser = new(User); *xUser = *user }
+
+    storage.rwMutex.RUnlock()
+    return xUser, nil
+}
+
+func (storage *memoryStorage) FindUserById(id uint32) (*User, error) { // nillable first result
+    storage.rwMutex.RLock()
+    user := storage.findUser(func(user *User) bool { return user.Id == id })
+
+    var xUser *User = nil
+    if user != nil { xUser = new(User); *xUser = *user }
+
+    storage.rwMutex.RUnlock()
+    return xUser, nil
+}
+
+func (storage *memoryStorage) AddUser(username []byte, hashedPassword []byte) (*User, error) { // nillable first result
+    storage.rwMutex.Lock()
+
+    if storage.findUser(func(user *User) bool { return xBytes.Equal(user.Name, username) }) != nil {
+        storage.rwMutex.Unlock()
+        return nil, nil
+    }
+
+    userId := storage.idsPool.TakeId()
+    if userId == nil {
+        storage.rwMutex.Unlock()
+        return nil, nil
+    }
+    utils.Assert(*userId > 0)
+
+    user := User{Id: *userId, Name: append([]byte(nil), username...), Password: append([]byte(nil), hashedPassword...), TokensRevokedMillis: utils.CurrentTimeMillis()} // the id may have belonged to a deleted user whose resume tokens mustn't let anyone in
+    storage.users = append(storage.users, user)
+
+    storage.rwMutex.Unlock()
+    return &user, nil
+}
+
+func (storage *memoryStorage) GetAllUsers() ([]User, error) {
+    storage.rwMutex.RLock()
+    users := append([]User(nil), storage.users...)
+    storage.rwMutex.RUnlock()
+
+    utils.Assert(len(users) > 0)
+    return users, nil
+}
+
+func (storage *memoryStorage) FindUsers(prefix []byte, ids []uint32, fromId uint32, limit uint32) ([]User, error) {
+    storage.rwMutex.RLock()
+
+    var users []User
+    for _, user := range storage.users {
+        if user.Id < fromId || !xBytes.HasPrefix(user.Name, prefix) { continue }
+        if ids != nil && !containsId(ids, user.Id) { continue }
+        users = append(users, user)
+    }
+
+    storage.rwMutex.RUnlock()
+
+    sort.Slice(users, func(i, j int) bool { return users[i].Id < users[j].Id })
+    if uint32(len(users)) > limit { users = users[:limit] }
+    return users, nil
+}
+
+func containsId(ids []uint32, id uint32) bool {
+    for _, i := range ids { if i == id { return true } }
+    return false
+}
+
+func (storage *memoryStorage) GetUsersCount() (uint32, error) {
+    storage.rwMutex.RLock()
+    count := uint32(len(storage.users))
+    storage.rwMutex.RUnlock()
+    return count, nil
+}
+
+func (storage *memoryStorage) UserExists(id uint32) (bool, error) {
+    storage.rwMutex.RLock()
+    exists := storage.findUser(func(user *User) bool { return user.Id == id }) != nil
+    storage.rwMutex.RUnlock()
+    return exists, nil
+}
+
+func (storage *memoryStorage) SetUserPassword(id uint32, hashedPassword []byte) error {
+    storage.rwMutex.Lock()
+    if user := storage.findUser(func(user *User) bool { return user.Id == id }); user != nil { user.Password = append([]byte(nil), hashedPassword...) }
+    storage.rwMutex.Unlock()
+    return nil
+}
+
+func (storage *memoryStorage) SetUserName(id uint32, username []byte) (bool, error) { // returns false if the username is already in use or there's no such user
+    storage.rwMutex.Lock()
+
+    if storage.findUser(func(user *User) bool { return xBytes.Equal(user.Name, username) }) != nil {
+        storage.rwMutex.Unlock()
+        return false, nil
+    }
+
+    user := storage.findUser(func(user *User) bool { return user.Id == id })
+    if user != nil { user.Name = append([]byte(nil), username...) }
+
+    storage.rwMutex.Unlock()
+    return user != nil, nil
+}
+
+func (storage *memoryStorage) SetUserBanned(id uint32, banned bool) (bool, error) { // returns false if there's no such user
+    storage.rwMutex.Lock()
+    user := storage.findUser(func(user *User) bool { return user.Id == id })
+    if user != nil { user.Banned = banned }
+    storage.rwMutex.Unlock()
+    return user != nil, nil
+}
+
+func (storage *memoryStorage) SetUserTokensRevokedMillis(id uint32, millis uint64) error {
+    storage.rwMutex.Lock()
+    if user := storage.findUser(func(user *User) bool { return user.Id == id }); user != nil { user.TokensRevokedMillis = millis }
+    storage.rwMutex.Unlock()
+    return nil
+}
+
+func (storage *memoryStorage) SetUserLastSeenMillis(id uint32, millis uint64) error {
+    storage.rwMutex.Lock()
+    if user := storage.findUser(func(user *User) bool { return user.Id == id }); user != nil { user.LastSeenMillis = millis }
+    storage.rwMutex.Unlock()
+    return nil
+}
+
+func (_ *memoryStorage) excludeMessagesOfUser(messages []Message, id uint32) []Message {
+    remaining := make([]Message, 0, len(messages))
+    for _, message := range messages {
+        if message.From != id && message.To != id { remaining = append(remaining, message) }
+    }
+    return remaining
+}
+
+func (storage *memoryStorage) DeleteUser(id uint32) (bool, error) { // returns false if there's no such user
+    storage.rwMutex.Lock()
+
+    remaining := make([]User, 0, len(storage.users))
+    for _, user := range storage.users {
+        if user.Id != id { remaining = append(remaining, user) }
+    }
+
+    deleted := len(remaining) != len(storage.users)
+    if deleted {
+        storage.users = remaining
+        storage.messages = storage.excludeMessagesOfUser(storage.messages, id)
+        storage.queue = storage.excludeMessagesOfUser(storage.queue, id)
+        storage.idsPool.ReturnId(id)
+    }
+
+    storage.rwMutex.Unlock()
+    return deleted, nil
+}
+
+func (_ *memoryStorage) filterMessages(messages []Message, predicate func(message *Message) bool) []Message { // returns a sorted by timestamp copy
+    var result []Message
+    for i := range messages {
+        if predicate(&(messages[i])) { result = append(result, messages[i]) }
+    }
+
+    sort.SliceStable(result, func(i, j int) bool { return result[i].Timestamp < result[j].Timestamp })
+    return result
+}
+
+func (storage *memoryStorage) GetMessagesFromOrForUser(from bool, id uint32, afterTimestamp uint64) ([]Message, error) {
+    storage.rwMutex.RLock()
+    messages := storage.filterMessages(storage.messages, func(message *Message) bool {
+        if from { return message.From == id && message.Room == 0 && message.Timestamp > afterTimestamp } else { return message.To == id && message.Timestamp > afterTimestamp }
+    })
+    storage.rwMutex.RUnlock()
+    return messages, nil
+}
+
+func (storage *memoryStorage) GetConversation(first uint32, second uint32, after MessageCursor, before MessageCursor, limit uint32, latest bool) ([]Message, error) {
+    return storage.getPage(after, before, limit, latest, func(message *Message) bool {
+        return message.From == first && message.To == second || message.From == second && message.To == first
+    }), nil
+}
+
+func (storage *memoryStorage) GetRoomMessages(room uint32, after MessageCursor, before MessageCursor, limit uint32, latest bool) ([]Message, error) {
+    return storage.getPage(after, before, limit, latest, func(message *Message) bool { return message.Room == room }), nil
+}
+
+func (storage *memoryStorage) getPage(after MessageCursor, before MessageCursor, limit uint32, latest bool, predicate func(message *Message) bool) []Message {
+    storage.rwMutex.RLock()
+    messages := storage.filterMessages(storage.messages, func(message *Message) bool {
+        if cursor := message.cursor(); !after.precedes(cursor) || !cursor.precedes(before) { return false }
+        return predicate(message)
+    })
+    storage.rwMutex.RUnlock()
+
+    sort.SliceStable(messages, func(i, j int) bool { return messages[i].cursor().precedes(messages[j].cursor()) })
+
+    if uint32(len(messages)) <= limit { return messages }
+    if latest { return messages[uint32(len(messages)) - limit:] } else { return messages[:limit] }
+}
+
+func (storage *memoryStorage) AddMessage(message Message) error {
+    storage.rwMutex.Lock()
+    storage.messages = append(storage.messages, message)
+    storage.rwMutex.Unlock()
+    return nil
+}
+
+func (storage *memoryStorage) deleteMessages(predicate func(index int, message *Message) bool) uint64 { // must be called with the mutex locked
+    kept := make([]Message, 0, len(storage.messages))
+    for i := range storage.messages {
+        if !predicate(i, &(storage.messages[i])) { kept = append(kept, storage.messages[i]) }
+    }
+
+    deleted := uint64(len(storage.messages) - len(kept))
+    storage.messages = kept
+    return deleted
+}
+
+func (storage *memoryStorage) DeleteMessagesBefore(receivedMillis uint64) (uint64, error) {
+    storage.rwMutex.Lock()
+    deleted := storage.deleteMessages(func(_ int, message *Message) bool { return message.ReceivedMillis < receivedMillis })
+    storage.rwMutex.Unlock()
+    return deleted, nil
+}
+
+func (storage *memoryStorage) TrimMessages(maxPerSender uint32) (uint64, error) {
+    storage.rwMutex.Lock()
+
+    newestFirst := make([]int, len(storage.messages))
+    for i := range newestFirst { newestFirst[i] = i }
+    sort.SliceStable(newestFirst, func(i, j int) bool { return storage.messages[newestFirst[i]].ReceivedMillis > storage.messages[newestFirst[j]].ReceivedMillis })
+
+    counts := make(map[uint32]uint32)
+    excess := make(map[int]bool)
+    for _, i := range newestFirst {
+        from := storage.messages[i].From
+        if counts[from]++; counts[from] > maxPerSender { excess[i] = true }
+    }
+
+    deleted := storage.deleteMessages(func(index int, _ *Message) bool { return excess[index] })
+    storage.rwMutex.Unlock()
+    return deleted, nil
+}
+
+func (storage *memoryStorage) DeleteMessages(first uint32, second *uint32) (uint64, error) {
+    storage.rwMutex.Lock()
+    deleted := storage.deleteMessages(func(_ int, message *Message) bool {
+        if second == nil { return message.From == first || message.To == first }
+        return message.From == first && message.To == *second || message.From == *second && message.To == first
+    })
+    storage.rwMutex.Unlock()
+    return deleted, nil
+}
+
+func (storage *memoryStorage) EnqueueMessage(message Message) error {
+    storage.rwMutex.Lock()
+    storage.queue = append(storage.queue, message)
+    storage.rwMutex.Unlock()
+    return nil
+}
+
+func (storage *memoryStorage) GetQueuedMessages(to uint32) ([]Message, error) {
+    storage.rwMutex.RLock()
+    messages := storage.filterMessages(storage.queue, func(message *Message) bool { return message.To == to })
+    storage.rwMutex.RUnlock()
+    return messages, nil
+}
+
+func (storage *memoryStorage) DequeueMessage(to uint32, id uint64) (bool, error) { // returns true if the message was in the queue
+    storage.rwMutex.Lock()
+
+    dequeued := false
+    for index, message := range storage.queue {
+        if message.To != to || message.Id != id { continue }
+
+        storage.queue = append(storage.queue[:index], storage.queue[index + 1:]...)
+        dequeued = true
+        break
+    }
+
+    storage.rwMutex.Unlock()
+    return dequeued, nil
+}
+
+func (storage *memoryStorage) SetMessageStatus(to uint32, id uint64, status uint8) (*Message, error) { // nillable first result
+    storage.rwMutex.Lock()
+
+    var changed *Message = nil
+    for i := range storage.messages {
+        message := &(storage.messages[i])
+        if message.To != to || message.Id != id || message.Status >= status { continue }
+
+        previous := *message
+        changed = &previous
+
+        message.Status = status
+        break
+    }
+
+    storage.rwMutex.Unlock()
+    return changed, nil
+}
+
+func (storage *memoryStorage) UpdateMessage(from uint32, id uint64, body []byte, editedMillis uint64) (*Message, error) { // nillable first result
+    storage.rwMutex.Lock()
+
+    var updated *Message = nil
+    for i := range storage.messages {
+        message := &(storage.messages[i])
+        if message.From != from || message.Id != id || message.Deleted { continue }
+
+        previous := *message
+        updated = &previous
+
+        message.Body = append([]byte(nil), body...)
+        message.EditedMillis = editedMillis
+        message.Deleted = len(body) == 0
+        break
+    }
+
+    for i := range storage.queue {
+        message := &(storage.queue[i])
+        if updated == nil || message.Id != id || updated.Room == 0 && message.To != updated.To { continue } // every member's copy of a room message
+
+        message.Body = append([]byte(nil), body...)
+    }
+
+    storage.rwMutex.Unlock()
+    return updated, nil
+}
+
+func (storage *memoryStorage) findRoom(id uint32) *Room { // nillable result
+    for i := range storage.rooms {
+        if storage.rooms[i].Id == id { return &(storage.rooms[i]) }
+    }
+    return nil
+}
+
+func (storage *memoryStorage) AddRoom(name []byte, owner uint32) (*Room, error) { // nillable first result
+    storage.rwMutex.Lock()
+
+    roomId := storage.roomIdsPool.TakeId()
+    if roomId == nil {
+        storage.rwMutex.Unlock()
+        return nil, nil
+    }
+
+    room := Room{Id: *roomId, Name: append([]byte(nil), name...), Owner: owner}
+    storage.rooms = append(storage.rooms, room)
+
+    storage.rwMutex.Unlock()
+    return &room, nil
+}
+
+func (storage *memoryStorage) GetRoom(id uint32) (*Room, error) { // nillable first result
+    storage.rwMutex.RLock()
+
+    var xRoom *Room = nil
+    if room := storage.findRoom(id); room != nil { xRoom = new(Room); *xRoom = *room }
+
+    storage.rwMutex.RUnlock()
+    return xRoom, nil
+}
+
+func (storage *memoryStorage) SetRoomOwner(id uint32, owner uint32) error {
+    storage.rwMutex.Lock()
+    if room := storage.findRoom(id); room != nil { room.Owner = owner }
+    storage.rwMutex.Unlock()
+    return nil
+}
+
+func (storage *memoryStorage) DeleteRoom(id uint32) error {
+    storage.rwMutex.Lock()
+
+    remainingMemberships := make([]Membership, 0, len(storage.memberships))
+    for _, membership := range storage.memberships {
+        if membership.Room != id { remainingMemberships = append(remainingMemberships, membership) }
+    }
+    storage.memberships = remainingMemberships
+
+    remainingRooms := make([]Room, 0, len(storage.rooms))
+    for _, room := range storage.rooms {
+        if room.Id != id { remainingRooms = append(remainingRooms, room) }
+    }
+
+    if len(remainingRooms) != len(storage.rooms) { storage.roomIdsPool.ReturnId(id) }
+    storage.rooms = remainingRooms
+
+    storage.rwMutex.Unlock()
+    return nil
+}
+
+func (storage *memoryStorage) AddRoomMember(room uint32, user uint32) (bool, error) {
+    storage.rwMutex.Lock()
+
+    for _, membership := range storage.memberships {
+        if membership.Room == room && membership.User == user {
+            storage.rwMutex.Unlock()
+            return false, nil
+        }
+    }
+
+    storage.memberships = append(storage.memberships, Membership{room, user})
+    storage.rwMutex.Unlock()
+    return true, nil
+}
+
+func (storage *memoryStorage) RemoveRoomMember(room uint32, user uint32) (bool, error) {
+    storage.rwMutex.Lock()
+
+    remaining := make([]Membership, 0, len(storage.memberships))
+    for _, membership := range storage.memberships {
+        if membership.Room != room || membership.User != user { remaining = append(remaining, membership) }
+    }
+
+    removed := len(remaining) != len(storage.memberships)
+    storage.memberships = remaining
+
+    storage.rwMutex.Unlock()
+    return removed, nil
+}
+
+func (storage *memoryStorage) GetRoomMembers(room uint32) ([]uint32, error) {
+    storage.rwMutex.RLock()
+
+    var members []uint32
+    for _, membership := range storage.memberships {
+        if membership.Room == room { members = append(members, membership.User) }
+    }
+
+    storage.rwMutex.RUnlock()
+    return members, nil
+}
+
+func (storage *memoryStorage) GetUserRooms(user uint32) ([]Room, error) {
+    storage.rwMutex.RLock()
+
+    var rooms []Room
+    for _, membership := range storage.memberships {
+        if membership.User != user { continue }
+        if room := storage.findRoom(membership.Room); room != nil { rooms = append(rooms, *room) }
+    }
+
+    storage.rwMutex.RUnlock()
+
+    sort.Slice(rooms, func(i, j int) bool { return rooms[i].Id < rooms[j].Id })
+    return rooms, nil
+}
+
+func (storage *memoryStorage) LoadOrStoreKey(name string, key []byte) ([]byte, error) {
+    storage.rwMutex.Lock()
+
+    stored, ok := storage.keys[name]
+    if !ok {
+        stored = append([]byte(nil), key...)
+        storage.keys[name] = stored
+    }
+
+    storage.rwMutex.Unlock()
+    return append([]byte(nil), stored...), nil
+}
+
+func (storage *memoryStorage) GetIdsPools() (*xIdsPool.IdsPool, *xIdsPool.IdsPool) { return storage.idsPool, storage.roomIdsPool }
@@ -0,0 +1,718 @@
+/*
+ * Exchatge - a secured realtime message exchanger (server).
+ * Copyright (C) 2023-2024  Vadim Nikolaev (https://github.com/vadniks)
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+
+package database
+
+import (
+    xIdsPool "ExchatgeServer/idsPool"
+    "ExchatgeServer/logging"
+    "ExchatgeServer/utils"
+    "context"
+    "errors"
+    "fmt"
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/mongo"
+    "go.mongodb.org/mongo-driver/mongo/options"
+    "go.mongodb.org/mongo-driver/mongo/readpref"
+    "reflect"
+    "strings"
+    "sync"
+    "time"
+)
+
+const databaseName = "admin"
+const collectionUsers = "users"
+const collectionMessages = "messages"
+const collectionQueue = "queue"
+const collectionRooms = "rooms"
+const collectionMemberships = "memberships"
+const collectionKeys = "keys"
+
+const fieldRealId = "_id"
+const fieldId = "id"
+const fieldName = "name"
+const fieldPassword = "password"
+const fieldBanned = "banned"
+const fieldTokensRevokedMillis = "tokensRevokedMillis"
+const fieldLastSeenMillis = "lastSeenMillis"
+
+const fieldTimestamp = "timestamp"
+const fieldReceivedMillis = "receivedMillis"
+const fieldFrom = "from"
+const fieldTo = "to"
+const fieldBody = "body"
+const fieldEditedMillis = "editedMillis"
+const fieldDeleted = "deleted"
+const fieldStatus = "status"
+
+const pingTimeout = 2 * time.Second
+const serverSelectionTimeout = 3 * time.Second // how long a call waits for the database while it's down, before failing
+
+const fieldOwner = "owner"
+const fieldRoom = "room"
+const fieldUser = "user"
+
+type storedKey struct {
+    Name string `bson:"name"`
+    Value []byte `bson:"value"`
+}
+
+type mongoStorage struct {
+    ctx *context.Context
+    users *mongo.Collection
+    messages *mongo.Collection
+    queue *mongo.Collection // messages awaiting acknowledgement from their recipients
+    rooms *mongo.Collection
+    memberships *mongo.Collection
+    keys *mongo.Collection // server's persisted secrets
+    client *mongo.Client
+    idsPool *xIdsPool.IdsPool
+    roomIdsPool *xIdsPool.IdsPool
+    rwMutex sync.RWMutex
+}
+
+type Backoff struct { // of the startup connection attempts
+    Tries uint
+    InitialMillis uint
+    MaxMillis uint // the delay doubles after each failed attempt up to this one
+}
+
+func InitMongoStorage(maxUsersCount uint32, mongoUrl string, backoff Backoff) (Storage, error) { // nillable first result
+    utils.Assert(backoff.Tries > 0)
+    ctx := context.TODO()
+
+    client, err := mongo.Connect(ctx, options.Client().ApplyURI(mongoUrl).SetServerSelectionTimeout(serverSelectionTimeout))
+    if err != nil { return nil, err }
+
+    delayMillis := backoff.InitialMillis
+    for try := uint(1); ; try++ {
+        if err = ping(ctx, client); err == nil { break }
+
+        if try >= backoff.Tries {
+            _ = client.Disconnect(ctx)
+            return nil, fmt.Errorf("the database is unavailable after %d tries: %w", try, err)
+        }
+
+        logging.Info("waiting for the database to become available", logging.F("try", try), logging.F("maxTries", backoff.Tries), logging.F("delayMillis", delayMillis), logging.Err(err))
+        time.Sleep(time.Duration(delayMillis) * time.Millisecond)
+
+        delayMillis *= 2
+        if delayMillis > backoff.MaxMillis { delayMillis = backoff.MaxMillis }
+    }
+
+    storage := &mongoStorage{
+        &ctx,
+        client.Database(databaseName).Collection(collectionUsers),
+        client.Database(databaseName).Collection(collectionMessages),
+        client.Database(databaseName).Collection(collectionQueue),
+        client.Database(databaseName).Collection(collectionRooms),
+        client.Database(databaseName).Collection(collectionMemberships),
+        client.Database(databaseName).Collection(collectionKeys),
+        client,
+        xIdsPool.InitIdsPool(maxUsersCount),
+        xIdsPool.InitIdsPool(maxRoomsCount),
+        sync.RWMutex{},
+    }
+
+    storage.loadIds()
+    return storage, nil
+}
+
+func ping(ctx context.Context, client *mongo.Client) error {
+    xCtx, cancel := context.WithTimeout(ctx, pingTimeout)
+    err := client.Ping(xCtx, readpref.Primary())
+    cancel()
+    return err
+}
+
+func (storage *mongoStorage) Ping() error { return ping(*(storage.ctx), storage.client) }
+
+func (storage *mongoStorage) loadIds() {
+    cursor, err := storage.users.Find(*(storage.ctx), bson.D{})
+    utils.Assert(err == nil)
+
+    var users []User
+    utils.Assert(cursor.All(*(storage.ctx), &users) == nil)
+
+    for _, i := range users {
+        storage.idsPool.SetId(i.Id, true)
+    }
+
+    cursor, err = storage.rooms.Find(*(storage.ctx), bson.D{})
+    utils.Assert(err == nil)
+
+    var rooms []Room
+    utils.Assert(cursor.All(*(storage.ctx), &rooms) == nil)
+
+    storage.roomIdsPool.SetId(0, true) // 0 means there's no room
+    for _, i := range rooms {
+        storage.roomIdsPool.SetId(i.Id, true)
+    }
+}
+
+func (storage *mongoStorage) Destroy() {
+    storage.rwMutex.Lock()
+    result := storage.client.Database(databaseName).RunCommand(*(storage.ctx), bson.D{{"shutdown", 1}})
+
+    utils.Assert(
+        result != nil &&
+        result.Err() != nil &&
+        strings.Contains(result.Err().Error(), "socket was unexpectedly closed: EOF"),
+    )
+
+    utils.Assert(storage.client.Disconnect(*(storage.ctx)) == nil)
+    storage.rwMutex.Unlock()
+}
+
+func (storage *mongoStorage) AddAdminIfNotExists(username []byte, hashedPassword []byte) {
+    storage.rwMutex.Lock()
+
+    if result := storage.users.FindOne(
+        *(storage.ctx),
+        bson.D{{fieldId, 0}, {fieldName, username}},
+    ); errors.Is(result.Err(), mongo.ErrNoDocuments) {
+        _, err := storage.users.InsertOne(*(storage.ctx), User{Id: 0, Name: username, Password: hashedPassword})
+        utils.Assert(err == nil)
+    }
+
+    storage.idsPool.SetId(0, true)
+    storage.rwMutex.Unlock()
+}
+
+func (storage *mongoStorage) FindUserByName(username []byte) (*User, error) { // nillable first result
+    storage.rwMutex.RLock()
+    result := storage.users.FindOne(*(storage.ctx), bson.D{{fieldName, username}})
+    storage.rwMutex.RUnlock()
+
+    if errors.Is(result.Err(), mongo.ErrNoDocuments) { return nil, nil }
+    if result.Err() != nil { return nil, result.Err() }
+
+    user := new(User)
+    if err := result.Decode(user); err != nil { return nil, err }
+    return user, nil
+}
+
+func (storage *mongoStorage) FindUserById(id uint32) (*User, error) { // nillable first result
+    storage.rwMutex.RLock()
+    result := storage.users.FindOne(*(storage.ctx), bson.D{{fieldId, id}})
+    storage.rwMutex.RUnlock()
+
+    if errors.Is(result.Err(), mongo.ErrNoDocuments) { return nil, nil }
+    if result.Err() != nil { return nil, result.Err() }
+
+    user := new(User)
+    if err := result.Decode(user); err != nil { return nil, err }
+    return user, nil
+}
+
+func (storage *mongoStorage) usernameAlreadyInUse(username []byte) (bool, error) { // username must be unique
+    result := storage.users.FindOne(*(storage.ctx), bson.D{{fieldName, username}})
+
+    if errors.Is(result.Err(), mongo.ErrNoDocuments) { return false, nil }
+    return result.Err() == nil, result.Err()
+}
+
+func (storage *mongoStorage) AddUser(username []byte, hashedPassword []byte) (*User, error) { // nillable first result
+    storage.rwMutex.Lock()
+
+    if inUse, err := storage.usernameAlreadyInUse(username); inUse || err != nil {
+        storage.rwMutex.Unlock()
+        return nil, err
+    }
+
+    userId := storage.idsPool.TakeId()
+    if userId == nil {
+        storage.rwMutex.Unlock()
+        return nil, nil
+    }
+    utils.Assert(*userId > 0)
+
+    result, err := storage.users.InsertOne(*(storage.ctx), User{Id: *userId, Name: username, Password: hashedPassword, TokensRevokedMillis: utils.CurrentTimeMillis()}) // the id may have belonged to a deleted user whose resume tokens mustn't let anyone in
+    if result == nil || err != nil {
+        storage.idsPool.ReturnId(*userId)
+        storage.rwMutex.Unlock()
+        return nil, err
+    }
+
+    result2 := storage.users.FindOne(*(storage.ctx), bson.D{{fieldRealId, result.InsertedID}})
+    if result2.Err() != nil {
+        storage.rwMutex.Unlock()
+        return nil, result2.Err()
+    }
+
+    user := new(User)
+    if err = result2.Decode(user); err != nil {
+        storage.rwMutex.Unlock()
+        return nil, err
+    }
+    utils.Assert(user.Id > 0 && reflect.DeepEqual(username, user.Name) && reflect.DeepEqual(hashedPassword, user.Password))
+
+    storage.rwMutex.Unlock()
+    return user, nil
+}
+
+func (storage *mongoStorage) GetAllUsers() ([]User, error) {
+    storage.rwMutex.RLock()
+    cursor, err := storage.users.Find(*(storage.ctx), bson.D{})
+    storage.rwMutex.RUnlock()
+
+    if err != nil { return nil, err }
+
+    var users []User
+    if err = cursor.All(*(storage.ctx), &users); err != nil { return nil, err }
+
+    utils.Assert(len(users) > 0) // admin is always there
+    return users, nil
+}
+
+func (storage *mongoStorage) FindUsers(prefix []byte, ids []uint32, fromId uint32, limit uint32) ([]User, error) {
+    filter := bson.M{fieldId: bson.M{"$gte": fromId}}
+    if ids != nil { filter[fieldId] = bson.M{"$gte": fromId, "$in": ids} }
+
+    if len(prefix) > 0 { // names are stored padded to the same size and binary data of the same size is compared byte by byte
+        lowest, highest := make([]byte, len(adminUsername)), make([]byte, len(adminUsername))
+        for i := len(prefix); i < len(highest); i++ { highest[i] = 0xff }
+        copy(lowest, prefix)
+        copy(highest, prefix)
+
+        filter[fieldName] = bson.M{"$gte": lowest, "$lte": highest}
+    }
+
+    storage.rwMutex.RLock()
+    cursor, err := storage.users.Find(
+        *(storage.ctx),
+        filter,
+        options.Find().SetSort(bson.D{{fieldId, 1}}).SetLimit(int64(limit)),
+    )
+    storage.rwMutex.RUnlock()
+
+    if err != nil { return nil, err }
+
+    var users []User
+    if err = cursor.All(*(storage.ctx), &users); err != nil { return nil, err }
+    return users, nil
+}
+
+func (storage *mongoStorage) GetUsersCount() (uint32, error) {
+    storage.rwMutex.RLock()
+    count, err := storage.users.EstimatedDocumentCount(*(storage.ctx))
+    storage.rwMutex.RUnlock()
+
+    return uint32(count), err
+}
+
+func (storage *mongoStorage) UserExists(id uint32) (bool, error) {
+    storage.rwMutex.RLock()
+    result := storage.users.FindOne(*(storage.ctx), bson.D{{fieldId, id}})
+    storage.rwMutex.RUnlock()
+
+    if errors.Is(result.Err(), mongo.ErrNoDocuments) { return false, nil }
+    return result.Err() == nil, result.Err()
+}
+
+func (storage *mongoStorage) SetUserPassword(id uint32, hashedPassword []byte) error {
+    storage.rwMutex.Lock()
+    _, err := storage.users.UpdateOne(*(storage.ctx), bson.D{{fieldId, id}}, bson.D{{"$set", bson.D{{fieldPassword, hashedPassword}}}})
+    storage.rwMutex.Unlock()
+
+    return err
+}
+
+func (storage *mongoStorage) SetUserName(id uint32, username []byte) (bool, error) { // returns false if the username is already in use or there's no such user
+    storage.rwMutex.Lock()
+
+    if inUse, err := storage.usernameAlreadyInUse(username); inUse || err != nil {
+        storage.rwMutex.Unlock()
+        return false, err
+    }
+
+    result, err := storage.users.UpdateOne(*(storage.ctx), bson.D{{fieldId, id}}, bson.D{{"$set", bson.D{{fieldName, username}}}})
+    storage.rwMutex.Unlock()
+
+    if err != nil { return false, err }
+    return result.MatchedCount > 0, nil
+}
+
+func (storage *mongoStorage) SetUserBanned(id uint32, banned bool) (bool, error) { // returns false if there's no such user
+    storage.rwMutex.Lock()
+    result, err := storage.users.UpdateOne(*(storage.ctx), bson.D{{fieldId, id}}, bson.D{{"$set", bson.D{{fieldBanned, banned}}}})
+    storage.rwMutex.Unlock()
+
+    if err != nil { return false, err }
+    return result.MatchedCount > 0, nil
+}
+
+func (storage *mongoStorage) SetUserTokensRevokedMillis(id uint32, millis uint64) error {
+    storage.rwMutex.Lock()
+    _, err := storage.users.UpdateOne(*(storage.ctx), bson.D{{fieldId, id}}, bson.D{{"$set", bson.D{{fieldTokensRevokedMillis, millis}}}})
+    storage.rwMutex.Unlock()
+
+    return err
+}
+
+func (storage *mongoStorage) SetUserLastSeenMillis(id uint32, millis uint64) error {
+    storage.rwMutex.Lock()
+    _, err := storage.users.UpdateOne(*(storage.ctx), bson.D{{fieldId, id}}, bson.D{{"$set", bson.D{{fieldLastSeenMillis, millis}}}})
+    storage.rwMutex.Unlock()
+
+    return err
+}
+
+func (storage *mongoStorage) DeleteUser(id uint32) (bool, error) { // returns false if there's no such user
+    storage.rwMutex.Lock()
+
+    result, err := storage.users.DeleteOne(*(storage.ctx), bson.D{{fieldId, id}})
+    if err != nil || result.DeletedCount == 0 {
+        storage.rwMutex.Unlock()
+        return false, err
+    }
+    storage.idsPool.ReturnId(id)
+
+    ofUser := bson.M{"$or": bson.A{bson.M{fieldFrom: id}, bson.M{fieldTo: id}}}
+    if _, err = storage.messages.DeleteMany(*(storage.ctx), ofUser); err == nil {
+        _, err = storage.queue.DeleteMany(*(storage.ctx), ofUser)
+    }
+
+    storage.rwMutex.Unlock()
+    return true, err
+}
+
+func (storage *mongoStorage) findMessages(collection *mongo.Collection, filter bson.M) ([]Message, error) {
+    storage.rwMutex.RLock()
+    cursor, err := collection.Find(
+        *(storage.ctx),
+        filter,
+        options.Find().SetSort(bson.D{{fieldTimestamp, 1}}),
+    )
+    storage.rwMutex.RUnlock()
+
+    if err != nil { return nil, err }
+
+    var messages []Message
+    if err = cursor.All(*(storage.ctx), &messages); err != nil { return nil, err }
+    return messages, nil
+}
+
+func (storage *mongoStorage) GetMessagesFromOrForUser(from bool, id uint32, afterTimestamp uint64) ([]Message, error) {
+    var field string
+    if from { field = fieldFrom } else { field = fieldTo }
+
+    filter := bson.M{field: id, fieldTimestamp: bson.M{"$gt": afterTimestamp}}
+    if from { filter[fieldRoom] = bson.M{"$not": bson.M{"$gt": 0}} } // the room messages are fetched by the members only
+
+    return storage.findMessages(storage.messages, filter)
+}
+
+func (storage *mongoStorage) GetConversation(first uint32, second uint32, after MessageCursor, before MessageCursor, limit uint32, latest bool) ([]Message, error) {
+    return storage.getPage(bson.M{"$or": bson.A{bson.M{fieldFrom: first, fieldTo: second}, bson.M{fieldFrom: second, fieldTo: first}}}, after, before, limit, latest)
+}
+
+func (storage *mongoStorage) GetRoomMessages(room uint32, after MessageCursor, before MessageCursor, limit uint32, latest bool) ([]Message, error) {
+    return storage.getPage(bson.M{fieldRoom: room}, after, before, limit, latest)
+}
+
+func (storage *mongoStorage) getPage(ofWhom bson.M, after MessageCursor, before MessageCursor, limit uint32, latest bool) ([]Message, error) {
+    filter := bson.M{"$and": bson.A{
+        ofWhom,
+        bson.M{"$or": bson.A{bson.M{fieldTimestamp: bson.M{"$gt": after.Timestamp}}, bson.M{fieldTimestamp: after.Timestamp, fieldId: bson.M{"$gt": after.Id}}}},
+        bson.M{"$or": bson.A{bson.M{fieldTimestamp: bson.M{"$lt": before.Timestamp}}, bson.M{fieldTimestamp: before.Timestamp, fieldId: bson.M{"$lt": before.Id}}}},
+    }}
+
+    order := 1
+    if latest { order = -1 } // take the latest ones first and then restore the order
+
+    storage.rwMutex.RLock()
+    cursor, err := storage.messages.Find(
+        *(storage.ctx),
+        filter,
+        options.Find().SetSort(bson.D{{fieldTimestamp, order}, {fieldId, order}}).SetLimit(int64(limit)),
+    )
+    storage.rwMutex.RUnlock()
+
+    if err != nil { return nil, err }
+
+    var messages []Message
+    if err = cursor.All(*(storage.ctx), &messages); err != nil { return nil, err }
+
+    if latest {
+        for i, j := 0, len(messages) - 1; i < j; i, j = i + 1, j - 1 { messages[i], messages[j] = messages[j], messages[i] }
+    }
+    return messages, nil
+}
+
+func (storage *mongoStorage) AddMessage(message Message) error {
+    storage.rwMutex.Lock()
+    _, err := storage.messages.InsertOne(*(storage.ctx), message)
+    storage.rwMutex.Unlock()
+
+    return err
+}
+
+func (storage *mongoStorage) deleteMessages(filter bson.M) (uint64, error) {
+    storage.rwMutex.Lock()
+    result, err := storage.messages.DeleteMany(*(storage.ctx), filter)
+    storage.rwMutex.Unlock()
+
+    if err != nil { return 0, err }
+    return uint64(result.DeletedCount), nil
+}
+
+func (storage *mongoStorage) DeleteMessagesBefore(receivedMillis uint64) (uint64, error) {
+    return storage.deleteMessages(bson.M{"$or": bson.A{
+        bson.M{fieldReceivedMillis: bson.M{"$lt": receivedMillis}},
+        bson.M{fieldReceivedMillis: bson.M{"$exists": false}, fieldTimestamp: bson.M{"$lt": receivedMillis}}, // stored before the receiving time was
+    }})
+}
+
+func (storage *mongoStorage) TrimMessages(maxPerSender uint32) (uint64, error) { // finds the senders beyond the limit, then deletes what's older than each one's oldest message to keep
+    storage.rwMutex.RLock()
+    cursor, err := storage.messages.Aggregate(*(storage.ctx), bson.A{
+        bson.M{"$group": bson.M{fieldRealId: "$" + fieldFrom, "count": bson.M{"$sum": 1}}},
+        bson.M{"$match": bson.M{"count": bson.M{"$gt": maxPerSender}}},
+    })
+    storage.rwMutex.RUnlock()
+
+    if err != nil { return 0, err }
+
+    var senders []struct{ Id uint32 `bson:"_id"` }
+    if err = cursor.All(*(storage.ctx), &senders); err != nil { return 0, err }
+
+    deleted := uint64(0)
+    for _, sender := range senders {
+        storage.rwMutex.RLock()
+        result := storage.messages.FindOne(
+            *(storage.ctx),
+            bson.M{fieldFrom: sender.Id},
+            options.FindOne().SetSort(bson.D{{fieldReceivedMillis, -1}}).SetSkip(int64(maxPerSender) - 1),
+        )
+        storage.rwMutex.RUnlock()
+
+        var oldestKept Message
+        if err = result.Decode(&oldestKept); errors.Is(err, mongo.ErrNoDocuments) { continue } else if err != nil { return deleted, err } // some have been deleted meanwhile
+
+        count, err := storage.deleteMessages(bson.M{fieldFrom: sender.Id, fieldReceivedMillis: bson.M{"$not": bson.M{"$gte": oldestKept.ReceivedMillis}}}) // the ones stored before the receiving time was are the oldest
+        deleted += count
+        if err != nil { return deleted, err }
+    }
+
+    return deleted, nil
+}
+
+func (storage *mongoStorage) DeleteMessages(first uint32, second *uint32) (uint64, error) {
+    if second == nil { return storage.deleteMessages(bson.M{"$or": bson.A{bson.M{fieldFrom: first}, bson.M{fieldTo: first}}}) }
+    return storage.deleteMessages(bson.M{"$or": bson.A{bson.M{fieldFrom: first, fieldTo: *second}, bson.M{fieldFrom: *second, fieldTo: first}}})
+}
+
+func (storage *mongoStorage) EnqueueMessage(message Message) error {
+    storage.rwMutex.Lock()
+    _, err := storage.queue.InsertOne(*(storage.ctx), message)
+    storage.rwMutex.Unlock()
+
+    return err
+}
+
+func (storage *mongoStorage) GetQueuedMessages(to uint32) ([]Message, error) {
+    return storage.findMessages(storage.queue, bson.M{fieldTo: to})
+}
+
+func (storage *mongoStorage) DequeueMessage(to uint32, id uint64) (bool, error) { // returns true if the message was in the queue
+    storage.rwMutex.Lock()
+    result, err := storage.queue.DeleteOne(*(storage.ctx), bson.M{fieldTo: to, fieldId: id})
+    storage.rwMutex.Unlock()
+
+    if err != nil { return false, err }
+    return result.DeletedCount > 0, nil
+}
+
+func (storage *mongoStorage) SetMessageStatus(to uint32, id uint64, status uint8) (*Message, error) { // nillable first result
+    storage.rwMutex.Lock()
+    result := storage.messages.FindOneAndUpdate(
+        *(storage.ctx),
+        bson.M{fieldId: id, fieldTo: to, fieldStatus: bson.M{"$not": bson.M{"$gte": status}}}, // matches the messages stored without a status as well
+        bson.M{"$set": bson.M{fieldStatus: status}},
+    )
+
+    changed := new(Message)
+    err := result.Decode(changed)
+    storage.rwMutex.Unlock()
+
+    if errors.Is(err, mongo.ErrNoDocuments) { return nil, nil }
+    if err != nil { return nil, err }
+    return changed, nil
+}
+
+func (storage *mongoStorage) UpdateMessage(from uint32, id uint64, body []byte, editedMillis uint64) (*Message, error) { // nillable first result
+    storage.rwMutex.Lock()
+    result := storage.messages.FindOneAndUpdate(
+        *(storage.ctx),
+        bson.M{fieldId: id, fieldFrom: from, fieldDeleted: bson.M{"$ne": true}},
+        bson.M{"$set": bson.M{fieldBody: body, fieldEditedMillis: editedMillis, fieldDeleted: len(body) == 0}},
+    )
+
+    updated := new(Message)
+    err := result.Decode(updated)
+    if err == nil && updated.Room == 0 { _, err = storage.queue.UpdateOne(*(storage.ctx), bson.M{fieldTo: updated.To, fieldId: id}, bson.M{"$set": bson.M{fieldBody: body}}) }
+    if err == nil && updated.Room > 0 { _, err = storage.queue.UpdateMany(*(storage.ctx), bson.M{fieldRoom: updated.Room, fieldId: id}, bson.M{"$set": bson.M{fieldBody: body}}) } // every member's copy
+    storage.rwMutex.Unlock()
+
+    if errors.Is(err, mongo.ErrNoDocuments) { return nil, nil }
+    if err != nil { return nil, err }
+    return updated, nil
+}
+
+func (storage *mongoStorage) AddRoom(name []byte, owner uint32) (*Room, error) { // nillable first result
+    storage.rwMutex.Lock()
+
+    roomId := storage.roomIdsPool.TakeId()
+    if roomId == nil {
+        storage.rwMutex.Unlock()
+        return nil, nil
+    }
+
+    room := &Room{Id: *roomId, Name: name, Owner: owner}
+    if _, err := storage.rooms.InsertOne(*(storage.ctx), room); err != nil {
+        storage.roomIdsPool.ReturnId(*roomId)
+        storage.rwMutex.Unlock()
+        return nil, err
+    }
+
+    storage.rwMutex.Unlock()
+    return room, nil
+}
+
+func (storage *mongoStorage) GetRoom(id uint32) (*Room, error) { // nillable first result
+    storage.rwMutex.RLock()
+    result := storage.rooms.FindOne(*(storage.ctx), bson.D{{fieldId, id}})
+    storage.rwMutex.RUnlock()
+
+    if errors.Is(result.Err(), mongo.ErrNoDocuments) { return nil, nil }
+    if result.Err() != nil { return nil, result.Err() }
+
+    room := new(Room)
+    if err := result.Decode(room); err != nil { return nil, err }
+    return room, nil
+}
+
+func (storage *mongoStorage) SetRoomOwner(id uint32, owner uint32) error {
+    storage.rwMutex.Lock()
+    _, err := storage.rooms.UpdateOne(*(storage.ctx), bson.D{{fieldId, id}}, bson.D{{"$set", bson.D{{fieldOwner, owner}}}})
+    storage.rwMutex.Unlock()
+
+    return err
+}
+
+func (storage *mongoStorage) DeleteRoom(id uint32) error {
+    storage.rwMutex.Lock()
+
+    if _, err := storage.memberships.DeleteMany(*(storage.ctx), bson.D{{fieldRoom, id}}); err != nil {
+        storage.rwMutex.Unlock()
+        return err
+    }
+
+    result, err := storage.rooms.DeleteOne(*(storage.ctx), bson.D{{fieldId, id}})
+    if err == nil && result.DeletedCount > 0 { storage.roomIdsPool.ReturnId(id) }
+
+    storage.rwMutex.Unlock()
+    return err
+}
+
+func (storage *mongoStorage) AddRoomMember(room uint32, user uint32) (bool, error) {
+    storage.rwMutex.Lock()
+
+    result := storage.memberships.FindOne(*(storage.ctx), bson.D{{fieldRoom, room}, {fieldUser, user}})
+    if !errors.Is(result.Err(), mongo.ErrNoDocuments) {
+        storage.rwMutex.Unlock()
+        return false, result.Err()
+    }
+
+    _, err := storage.memberships.InsertOne(*(storage.ctx), Membership{room, user})
+    storage.rwMutex.Unlock()
+
+    return err == nil, err
+}
+
+func (storage *mongoStorage) RemoveRoomMember(room uint32, user uint32) (bool, error) {
+    storage.rwMutex.Lock()
+    result, err := storage.memberships.DeleteOne(*(storage.ctx), bson.D{{fieldRoom, room}, {fieldUser, user}})
+    storage.rwMutex.Unlock()
+
+    if err != nil { return false, err }
+    return result.DeletedCount > 0, nil
+}
+
+func (storage *mongoStorage) findMemberships(filter bson.D) ([]Membership, error) {
+    storage.rwMutex.RLock()
+    cursor, err := storage.memberships.Find(*(storage.ctx), filter)
+    storage.rwMutex.RUnlock()
+
+    if err != nil { return nil, err }
+
+    var memberships []Membership
+    if err = cursor.All(*(storage.ctx), &memberships); err != nil { return nil, err }
+    return memberships, nil
+}
+
+func (storage *mongoStorage) GetRoomMembers(room uint32) ([]uint32, error) {
+    memberships, err := storage.findMemberships(bson.D{{fieldRoom, room}})
+    if err != nil { return nil, err }
+
+    var members []uint32
+    for _, membership := range memberships { members = append(members, membership.User) }
+    return members, nil
+}
+
+func (storage *mongoStorage) GetUserRooms(user uint32) ([]Room, error) {
+    memberships, err := storage.findMemberships(bson.D{{fieldUser, user}})
+    if err != nil || len(memberships) == 0 { return nil, err }
+
+    var ids []uint32
+    for _, membership := range memberships { ids = append(ids, membership.Room) }
+
+    storage.rwMutex.RLock()
+    cursor, err := storage.rooms.Find(*(storage.ctx), bson.M{fieldId: bson.M{"$in": ids}}, options.Find().SetSort(bson.D{{fieldId, 1}}))
+    storage.rwMutex.RUnlock()
+
+    if err != nil { return nil, err }
+
+    var rooms []Room
+    if err = cursor.All(*(storage.ctx), &rooms); err != nil { return nil, err }
+    return rooms, nil
+}
+
+func (storage *mongoStorage) LoadOrStoreKey(name string, key []byte) ([]byte, error) {
+    storage.rwMutex.Lock()
+    result := storage.keys.FindOne(*(storage.ctx), bson.D{{fieldName, name}})
+
+    if errors.Is(result.Err(), mongo.ErrNoDocuments) {
+        _, err := storage.keys.InsertOne(*(storage.ctx), storedKey{Name: name, Value: key})
+        storage.rwMutex.Unlock()
+
+        if err != nil { return nil, err }
+        return key, nil
+    }
+    storage.rwMutex.Unlock()
+
+    if result.Err() != nil { return nil, result.Err() }
+
+    stored := new(storedKey)
+    if err := result.Decode(stored); err != nil { return nil, err }
+    return stored.Value, nil
+}
+
+func (storage *mongoStorage) GetIdsPools() (*xIdsPool.IdsPool, *xIdsPool.IdsPool) { return storage.idsPool, storage.roomIdsPool }
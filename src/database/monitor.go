@@ -0,0 +1,94 @@
+/*
+ * Exchatge - a secured realtime message exchanger (server).
+ * Copyright (C) 2023-2024  Vadim Nikolaev (https://github.com/vadniks)
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+
+package database
+
+import (
+    "ExchatgeServer/logging"
+    "ExchatgeServer/metrics"
+    "ExchatgeServer/utils"
+    "sync/atomic"
+    "time"
+)
+
+type monitorT struct { // pings the storage periodically, the server runs in a degraded mode while it's unreachable
+    available atomic.Bool
+    wake chan struct{}
+    stop chan struct{}
+    started atomic.Bool
+}
+
+var monitor = newMonitor() // aka singleton
+
+func newMonitor() *monitorT {
+    xMonitor := &monitorT{atomic.Bool{}, make(chan struct{}, 1), make(chan struct{}), atomic.Bool{}}
+    xMonitor.available.Store(true)
+    return xMonitor
+}
+
+func Available() bool { return monitor.available.Load() } // false while the storage is unreachable
+
+func Monitor(intervalMillis uint) { // starts checking the storage's availability in the background
+    utils.Assert(this != nil && intervalMillis > 0)
+    if monitor.started.Swap(true) { return }
+
+    metrics.SetGauge("exchatge_database_available", "Whether the database is reachable", "storage", func() map[string]float64 {
+        if Available() { return map[string]float64{"default": 1} } else { return map[string]float64{"default": 0} }
+    })
+
+    storage, stop := this, monitor.stop
+    go func() {
+        for {
+            select {
+                case <-time.After(time.Duration(intervalMillis) * time.Millisecond): {}
+                case <-monitor.wake: {}
+                case <-stop: return
+            }
+
+            monitor.check(storage)
+        }
+    }()
+}
+
+func (monitor *monitorT) halt() { // lets Monitor be called again with another storage
+    if !monitor.started.Swap(false) { return }
+
+    close(monitor.stop)
+    monitor.stop = make(chan struct{})
+    monitor.available.Store(true)
+}
+
+func (monitor *monitorT) check(storage Storage) {
+    err := storage.Ping()
+
+    if err != nil && monitor.available.Swap(false) {
+        logging.Error("the database became unavailable, running in the degraded mode", logging.Err(err))
+    } else if err == nil && !monitor.available.Swap(true) {
+        logging.Info("the database is available again, running in the full mode")
+    }
+}
+
+func (monitor *monitorT) suspect() { // schedules an immediate check, doesn't block
+    if !monitor.started.Load() { return }
+
+    select {
+        case monitor.wake <- struct{}{}: {}
+        default: {}
+    }
+}
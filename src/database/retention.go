@@ -0,0 +1,93 @@
+/*
+ * Exchatge - a secured realtime message exchanger (server).
+ * Copyright (C) 2023-2024  Vadim Nikolaev (https://github.com/vadniks)
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+
+package database
+
+import (
+    "ExchatgeServer/logging"
+    "ExchatgeServer/metrics"
+    "ExchatgeServer/utils"
+    "sync/atomic"
+    "time"
+)
+
+type Retention struct {
+    MaxAgeMillis uint64 // 0 - messages don't expire
+    MaxPerSender uint32 // 0 - unlimited, otherwise only the latest messages of each sender are kept
+}
+
+type purgerT struct { // enforces the retention policy periodically
+    stop chan struct{}
+    started atomic.Bool
+}
+
+var purger = &purgerT{make(chan struct{}), atomic.Bool{}} // aka singleton
+
+var purgedMessages = metrics.NewCounter("exchatge_purged_messages_total", "Stored messages deleted by the retention policy or by the admin", "reason")
+
+func Purge(retention Retention) (uint64, error) { // enforces the retention policy once, returns the count of the deleted messages
+    deleted := uint64(0)
+
+    if now := utils.CurrentTimeMillis(); retention.MaxAgeMillis > 0 && now > retention.MaxAgeMillis {
+        count, err := this.DeleteMessagesBefore(now - retention.MaxAgeMillis)
+        purgedMessages.Add("age", count)
+        deleted += count
+        if err != nil { return deleted, err }
+    }
+
+    if retention.MaxPerSender > 0 {
+        count, err := this.TrimMessages(retention.MaxPerSender)
+        purgedMessages.Add("cap", count)
+        deleted += count
+        if err != nil { return deleted, err }
+    }
+
+    return deleted, nil
+}
+
+func StartPurger(retention Retention, intervalMillis uint) { // does nothing if the policy keeps everything
+    utils.Assert(this != nil && intervalMillis > 0)
+    if retention.MaxAgeMillis == 0 && retention.MaxPerSender == 0 || purger.started.Swap(true) { return }
+
+    stop := purger.stop
+    go func() {
+        for {
+            select {
+                case <-time.After(time.Duration(intervalMillis) * time.Millisecond): {}
+                case <-stop: return
+            }
+
+            if !Available() { continue } // will catch up after the database is back
+
+            deleted, err := Purge(retention)
+            if err != nil {
+                logging.Warning("purging messages failed", logging.F("deleted", deleted), logging.Err(err))
+            } else if deleted > 0 {
+                logging.Info("purged messages", logging.F("deleted", deleted))
+            }
+        }
+    }()
+}
+
+func (purger *purgerT) halt() { // lets StartPurger be called again with another storage
+    if !purger.started.Swap(false) { return }
+
+    close(purger.stop)
+    purger.stop = make(chan struct{})
+}
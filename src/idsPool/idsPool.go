@@ -89,3 +89,15 @@ func (pool *IdsPool) ReturnId(id uint32) {
 
     pool.mutex.Unlock()
 }
+
+func (pool *IdsPool) Occupancy() (uint32, uint32) { // returns taken ids count & the pool's size
+    pool.mutex.Lock()
+
+    taken := uint32(0)
+    for i := uint32(0); i < pool.size; i++ {
+        if pool.ids.Bit(int(i)) == uint(xTrue) { taken++ }
+    }
+
+    pool.mutex.Unlock()
+    return taken, pool.size
+}
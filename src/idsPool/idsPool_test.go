@@ -48,3 +48,13 @@ func TestBasic(t *testing.T) {
 
     if pool.TakeId() != nil { t.Error() }
 }
+
+func TestOccupancy(t *testing.T) {
+    pool := InitIdsPool(10)
+    if taken, size := pool.Occupancy(); taken != 0 || size != 10 { t.Error() }
+
+    for i := 0; i < 3; i++ { pool.TakeId() }
+    pool.ReturnId(1)
+
+    if taken, _ := pool.Occupancy(); taken != 2 { t.Error() }
+}
@@ -0,0 +1,196 @@
+/*
+ * Exchatge - a secured realtime message exchanger (server).
+ * Copyright (C) 2023-2024  Vadim Nikolaev (https://github.com/vadniks)
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+
+package logging
+
+import (
+    "encoding/json"
+    "fmt"
+    "io"
+    "os"
+    "strings"
+    "sync"
+    "time"
+)
+
+type Level int
+
+const (
+    LevelDebug Level = 0
+    LevelInfo Level = 1
+    LevelWarning Level = 2
+    LevelError Level = 3
+)
+
+const (
+    SinkStderr = "stderr"
+    SinkFile = "file"
+    FormatText = "text"
+    FormatJson = "json"
+
+    keptFilesCount = 5 // rotated ones, besides the current
+)
+
+var levelNames = [...]string{"debug", "info", "warning", "error"}
+
+type Field struct {
+    key string
+    value any
+}
+
+type rotatingFileT struct { // renames the file to file.1 (shifting the older ones) when it grows beyond the limit
+    path string
+    maxSize int64
+    size int64
+    file *os.File // nillable, if the file can't be opened logs go to the other sinks only
+}
+
+type loggerT struct {
+    level Level
+    json bool
+    stderr bool
+    file *rotatingFileT // nillable
+    mutex sync.Mutex
+}
+
+var this = &loggerT{LevelInfo, false, true, nil, sync.Mutex{}} // aka singleton; logs go to stderr until initialized
+
+func ParseLevel(value string) *Level { // nillable
+    for i, name := range levelNames {
+        if name == value {
+            level := Level(i)
+            return &level
+        }
+    }
+    return nil
+}
+
+func Initialize(level Level, format string, sinks []string, filePath string, maxFileSize int64) {
+    logger := &loggerT{level, format == FormatJson, false, nil, sync.Mutex{}}
+
+    for _, sink := range sinks {
+        switch sink {
+            case SinkStderr: logger.stderr = true
+            case SinkFile: logger.file = openRotatingFile(filePath, maxFileSize)
+        }
+    }
+
+    this.mutex.Lock()
+    if this.file != nil && this.file.file != nil { _ = this.file.file.Close() }
+    this.level, this.json, this.stderr, this.file = logger.level, logger.json, logger.stderr, logger.file
+    this.mutex.Unlock()
+}
+
+func openRotatingFile(path string, maxSize int64) *rotatingFileT {
+    rotatingFile := &rotatingFileT{path, maxSize, 0, nil}
+
+    file, err := os.OpenFile(path, os.O_CREATE | os.O_WRONLY | os.O_APPEND, 0600)
+    if err != nil { return rotatingFile }
+
+    if info, err := file.Stat(); err == nil { rotatingFile.size = info.Size() }
+    rotatingFile.file = file
+    return rotatingFile
+}
+
+func (rotatingFile *rotatingFileT) rotate() {
+    _ = rotatingFile.file.Close()
+
+    for i := keptFilesCount - 1; i > 0; i-- { _ = os.Rename(fmt.Sprintf("%s.%d", rotatingFile.path, i), fmt.Sprintf("%s.%d", rotatingFile.path, i + 1)) }
+    _ = os.Rename(rotatingFile.path, rotatingFile.path + ".1")
+
+    *rotatingFile = *openRotatingFile(rotatingFile.path, rotatingFile.maxSize)
+}
+
+func (rotatingFile *rotatingFileT) Write(bytes []byte) (int, error) {
+    if rotatingFile.file == nil { return len(bytes), nil }
+    if rotatingFile.size + int64(len(bytes)) > rotatingFile.maxSize && rotatingFile.size > 0 { rotatingFile.rotate() }
+    if rotatingFile.file == nil { return len(bytes), nil }
+
+    written, err := rotatingFile.file.Write(bytes)
+    rotatingFile.size += int64(written)
+    return written, err
+}
+
+func F(key string, value any) Field { return Field{key, value} }
+
+func ConnectionId(id uint32) Field { return Field{"connectionId", id} }
+
+func UserId(id uint32) Field { return Field{"userId", id} }
+
+func Flag(flag int32) Field { return Field{"flag", fmt.Sprintf("0x%08x", flag)} }
+
+func Address(address string) Field { return Field{"address", address} }
+
+func Err(err error) Field { return Field{"error", err.Error()} }
+
+func format(asJson bool, now time.Time, level Level, message string, fields []Field) []byte {
+    if asJson {
+        entry := map[string]any{"time": now.Format(time.RFC3339Nano), "level": levelNames[level], "message": message}
+        for _, field := range fields { entry[field.key] = field.value }
+
+        bytes, err := json.Marshal(entry)
+        if err != nil { bytes = []byte(fmt.Sprintf(`{"level":"error","message":"unable to format a log entry: %s"}`, err.Error())) }
+        return append(bytes, '\n')
+    }
+
+    var builder strings.Builder
+    builder.WriteString(now.Format("2006-01-02T15:04:05.000Z07:00"))
+    builder.WriteString(" ")
+    builder.WriteString(strings.ToUpper(levelNames[level]))
+    builder.WriteString(" ")
+    builder.WriteString(message)
+
+    for _, field := range fields {
+        if value, ok := field.value.(string); ok && strings.ContainsAny(value, " \"=") {
+            _, _ = fmt.Fprintf(&builder, " %s=%q", field.key, value)
+        } else {
+            _, _ = fmt.Fprintf(&builder, " %s=%v", field.key, field.value)
+        }
+    }
+
+    builder.WriteString("\n")
+    return []byte(builder.String())
+}
+
+func log(level Level, message string, fields []Field) {
+    this.mutex.Lock()
+
+    if level < this.level {
+        this.mutex.Unlock()
+        return
+    }
+
+    bytes := format(this.json, time.Now(), level, message, fields)
+
+    var sinks []io.Writer
+    if this.stderr { sinks = append(sinks, os.Stderr) }
+    if this.file != nil { sinks = append(sinks, this.file) }
+
+    for _, sink := range sinks { _, _ = sink.Write(bytes) }
+
+    this.mutex.Unlock()
+}
+
+func Debug(message string, fields ...Field) { log(LevelDebug, message, fields) }
+
+func Info(message string, fields ...Field) { log(LevelInfo, message, fields) }
+
+func Warning(message string, fields ...Field) { log(LevelWarning, message, fields) }
+
+func Error(message string, fields ...Field) { log(LevelError, message, fields) }
@@ -0,0 +1,58 @@
+/*
+ * Exchatge - a secured realtime message exchanger (server).
+ * Copyright (C) 2023-2024  Vadim Nikolaev (https://github.com/vadniks)
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+
+package logging
+
+import (
+    "encoding/json"
+    "os"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestFormat(t *testing.T) {
+    now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+    fields := []Field{ConnectionId(1), UserId(2), Flag(0x1f), F("cause", "unknown flag")}
+
+    text := string(format(false, now, LevelWarning, "connection interrupted", fields))
+    if text != "2024-01-02T03:04:05.000Z WARNING connection interrupted connectionId=1 userId=2 flag=0x0000001f cause=\"unknown flag\"\n" { t.Error(text) }
+
+    entry := make(map[string]any)
+    if json.Unmarshal(format(true, now, LevelError, "failed", fields), &entry) != nil { t.Fatal() }
+    if entry["level"] != "error" || entry["message"] != "failed" || entry["connectionId"] != float64(1) || entry["flag"] != "0x0000001f" { t.Error(entry) }
+
+    if level := ParseLevel("debug"); level == nil || *level != LevelDebug { t.Error() }
+    if ParseLevel("verbose") != nil { t.Error() }
+}
+
+func TestRotation(t *testing.T) {
+    path := t.TempDir() + "/test.log"
+
+    Initialize(LevelInfo, FormatText, []string{SinkFile}, path, 64)
+    for i := 0; i < 10; i++ { Info("a rather long message to rotate the file") }
+    Debug("dropped")
+    Initialize(LevelInfo, FormatText, []string{SinkStderr}, "", 0)
+
+    if _, err := os.Stat(path + ".1"); err != nil { t.Error() }
+    if _, err := os.Stat(path + ".6"); err == nil { t.Error() }
+
+    bytes, err := os.ReadFile(path)
+    if err != nil || strings.Contains(string(bytes), "dropped") { t.Error() }
+}
@@ -21,31 +21,26 @@ package main
 import (
     "ExchatgeServer/crypto"
     "ExchatgeServer/database"
+    "ExchatgeServer/logging"
+    "ExchatgeServer/metrics"
     "ExchatgeServer/net"
     "ExchatgeServer/options"
-    "ExchatgeServer/utils"
     "fmt"
     "os"
-    "os/exec"
     "strings"
     "time"
 )
 
-const databaseAvailabilityCheckMaxTries = 10 // at most 10 seconds timeout
-
-func checkDatabaseAvailability(url string) bool {
-    cmd := exec.Command("curl", "-f", url)
-    utils.Assert(cmd.Err == nil)
-
-    out, err := cmd.Output()
-    return err == nil && strings.Contains(string(out), "MongoDB")
-}
-
 ////////////////////////////////////////////////////////////////////////////////
 // REMEMBER TO DISABLE THAT F*** GoFMT IN IDE'S SETTINGS! HIS STYLE IS AWFUL! //
 ////////////////////////////////////////////////////////////////////////////////
 
 func main() {
+    if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+        os.Exit(runSubcommand(os.Args[1], os.Args[2:]))
+        return
+    }
+
     print(
         "\r\033[1;32m" + // Figlet
         "           _______ _     _ _______ _     _ _______ _______  ______ _______            \n" +
@@ -57,40 +52,78 @@ func main() {
         "\033[0m",
     )
 
-    println("Exchatge server started...")
+    logging.Info("Exchatge server started")
 
-    xOptions := options.Init(crypto.SecretKeySize, net.UnhashedPasswordSize)
-    if xOptions == nil {
-        println("unable to parse options, exiting...")
+    xOptions, err := options.Init(crypto.SecretKeySize, net.UnhashedPasswordSize, os.Args[1:])
+    if err != nil {
+        logging.Error("unable to parse options, exiting", logging.Err(err))
         os.Exit(1)
         return
     }
 
-    counter := 0
-    for !checkDatabaseAvailability(strings.Split(xOptions.MongodbUrl, "@")[1]) {
-        if counter >= databaseAvailabilityCheckMaxTries {
-            println("timeout exceeded, exiting...")
+    logging.Initialize(xOptions.LogLevel, xOptions.LogFormat, xOptions.LogSinks, xOptions.LogFile, int64(xOptions.LogFileMaxSize))
+
+    crypto.Initialize(xOptions.ServerPrivateSignKey)
+    if xOptions.NextServerPrivateSignKey != nil {
+        crypto.InitializeRotation(xOptions.NextServerPrivateSignKey, uint64(xOptions.SignKeyCutoverMillis), uint64(xOptions.SignKeyGraceMillis))
+        logging.Info("signing key rotation is planned", logging.F("cutover", time.UnixMilli(int64(xOptions.SignKeyCutoverMillis)).UTC().Format(time.RFC3339)), logging.F("rotated", crypto.SignKeyRotated()))
+    }
+
+    if xOptions.Storage == database.StorageMemory {
+        database.Initialize(database.InitMemoryStorage(uint32(xOptions.MaxUsersCount)), xOptions.AdminPassword)
+        logging.Warning("using the in-memory storage, nothing will be persisted")
+    } else {
+        storage, err := database.InitMongoStorage(uint32(xOptions.MaxUsersCount), xOptions.MongodbUrl, database.Backoff{
+            Tries: xOptions.DatabaseConnectTries,
+            InitialMillis: xOptions.DatabaseBackoffMillis,
+            MaxMillis: xOptions.DatabaseMaxBackoffMillis,
+        })
+        if err != nil {
+            logging.Error("unable to connect to the database, exiting", logging.Err(err))
             os.Exit(1)
             return
-        } else {
-            fmt.Printf("waiting for the database to become available (%d/%d)...\n", counter, databaseAvailabilityCheckMaxTries)
         }
 
-        counter++
-        time.Sleep(1e9) // 1 second = 1000 milliseconds = 1 000 000 000 nanoseconds
+        database.Initialize(storage, xOptions.AdminPassword)
+        database.Monitor(xOptions.DatabaseMonitorIntervalMillis)
+        logging.Info("connected to the database")
     }
 
-    crypto.Initialize(xOptions.ServerPrivateSignKey)
+    database.StartPurger(database.Retention{
+        MaxAgeMillis: uint64(xOptions.MessageMaxAgeMillis),
+        MaxPerSender: uint32(xOptions.MaxStoredMessagesPerSender),
+    }, xOptions.MessagePurgeIntervalMillis)
 
-    database.Initialize(uint32(xOptions.MaxUsersCount), xOptions.MongodbUrl, xOptions.AdminPassword)
-    println("connected to the database...")
+    resumeTokensKey, err := database.LoadResumeTokensKey()
+    if err != nil {
+        logging.Error("unable to load the resume tokens key, exiting", logging.Err(err))
+        os.Exit(1)
+        return
+    }
+    crypto.InitializeResumeTokens(resumeTokensKey)
+
+    net.Initialize(
+        xOptions.MaxUsersCount,
+        xOptions.MaxTimeMillisToPreserveActiveConnection,
+        xOptions.MaxTimeMillisIntervalBetweenMessages,
+        xOptions.MaxMessageSize,
+        xOptions.MaxMultipartMessageSize,
+        xOptions.ReassembleMessages,
+        xOptions.MaxTimeMillisToPreserveResumeToken,
+        net.RateLimit{PerSecond: xOptions.RateLimitMessages[0], Burst: xOptions.RateLimitMessages[1]},
+        net.RateLimit{PerSecond: xOptions.RateLimitQueries[0], Burst: xOptions.RateLimitQueries[1]},
+        net.RateLimit{PerSecond: xOptions.RateLimitAuthentication[0], Burst: xOptions.RateLimitAuthentication[1]},
+    )
+    if xOptions.MetricsPort > 0 {
+        metrics.Serve("127.0.0.1", xOptions.MetricsPort)
+        logging.Info("metrics are available", logging.F("url", fmt.Sprintf("http://127.0.0.1:%d/metrics", xOptions.MetricsPort)))
+    }
 
-    net.Initialize(xOptions.MaxUsersCount, xOptions.MaxTimeMillisToPreserveActiveConnection, xOptions.MaxTimeMillisIntervalBetweenMessages)
-    println("initialized; running")
+    logging.Info("initialized; running", logging.Address(fmt.Sprintf("%s:%d", xOptions.Host, xOptions.Port)))
 
     net.Net.ProcessClients(xOptions.Host, xOptions.Port)
 
-    println("shutting down...")
+    logging.Info("shutting down")
     database.Destroy()
-    println("Exiting now...")
+    logging.Info("exiting now")
 }
@@ -0,0 +1,201 @@
+/*
+ * Exchatge - a secured realtime message exchanger (server).
+ * Copyright (C) 2023-2024  Vadim Nikolaev (https://github.com/vadniks)
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+
+package metrics
+
+import (
+    "ExchatgeServer/logging"
+    "ExchatgeServer/utils"
+    "fmt"
+    "net/http"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+)
+
+type Counter struct {
+    name string
+    help string
+    label string
+    values map[string]uint64 // by label value
+}
+
+type histogramT struct {
+    counts []uint64 // cumulative is computed on exposition
+    sum float64
+    count uint64
+}
+
+type Histogram struct {
+    name string
+    help string
+    label string
+    buckets []float64 // upper bounds in seconds
+    entries map[string]*histogramT // by label value
+}
+
+type gaugeT struct {
+    name string
+    help string
+    label string
+    collect func() map[string]float64 // called on each scrape, by label value
+}
+
+type metricsT struct {
+    counters []*Counter
+    histograms []*Histogram
+    gauges []*gaugeT
+    mutex sync.Mutex
+}
+
+var this = &metricsT{nil, nil, nil, sync.Mutex{}} // aka singleton
+
+var latencyBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+
+func NewCounter(name string, help string, label string) *Counter {
+    counter := &Counter{name, help, label, make(map[string]uint64)}
+
+    this.mutex.Lock()
+    this.counters = append(this.counters, counter)
+    this.mutex.Unlock()
+
+    return counter
+}
+
+func (counter *Counter) Inc(labelValue string) { counter.Add(labelValue, 1) }
+
+func (counter *Counter) Add(labelValue string, value uint64) {
+    this.mutex.Lock()
+    counter.values[labelValue] += value
+    this.mutex.Unlock()
+}
+
+func NewLatencyHistogram(name string, help string, label string) *Histogram {
+    histogram := &Histogram{name, help, label, latencyBuckets, make(map[string]*histogramT)}
+
+    this.mutex.Lock()
+    this.histograms = append(this.histograms, histogram)
+    this.mutex.Unlock()
+
+    return histogram
+}
+
+func (histogram *Histogram) Observe(labelValue string, started time.Time) {
+    seconds := time.Since(started).Seconds()
+    this.mutex.Lock()
+
+    entry, ok := histogram.entries[labelValue]
+    if !ok {
+        entry = &histogramT{make([]uint64, len(histogram.buckets)), 0, 0}
+        histogram.entries[labelValue] = entry
+    }
+
+    for i, bound := range histogram.buckets {
+        if seconds <= bound {
+            entry.counts[i]++
+            break
+        }
+    }
+
+    entry.sum += seconds
+    entry.count++
+
+    this.mutex.Unlock()
+}
+
+func SetGauge(name string, help string, label string, collect func() map[string]float64) { // replaces the gauge with the same name if there's one
+    utils.Assert(collect != nil)
+    gauge := &gaugeT{name, help, label, collect}
+
+    this.mutex.Lock()
+
+    for i, existing := range this.gauges {
+        if existing.name == name {
+            this.gauges[i] = gauge
+            this.mutex.Unlock()
+            return
+        }
+    }
+    this.gauges = append(this.gauges, gauge)
+
+    this.mutex.Unlock()
+}
+
+func sortedKeys[T any](values map[string]T) []string {
+    keys := make([]string, 0, len(values))
+    for key := range values { keys = append(keys, key) }
+    sort.Strings(keys)
+    return keys
+}
+
+func expose() string { // Prometheus text format
+    var builder strings.Builder
+
+    this.mutex.Lock()
+    gauges := append([]*gaugeT(nil), this.gauges...)
+
+    for _, counter := range this.counters {
+        _, _ = fmt.Fprintf(&builder, "# HELP %s %s\n# TYPE %s counter\n", counter.name, counter.help, counter.name)
+        for _, key := range sortedKeys(counter.values) {
+            _, _ = fmt.Fprintf(&builder, "%s{%s=%q} %d\n", counter.name, counter.label, key, counter.values[key])
+        }
+    }
+
+    for _, histogram := range this.histograms {
+        _, _ = fmt.Fprintf(&builder, "# HELP %s %s\n# TYPE %s histogram\n", histogram.name, histogram.help, histogram.name)
+        for _, key := range sortedKeys(histogram.entries) {
+            entry := histogram.entries[key]
+
+            cumulative := uint64(0)
+            for i, bound := range histogram.buckets {
+                cumulative += entry.counts[i]
+                _, _ = fmt.Fprintf(&builder, "%s_bucket{%s=%q,le=\"%g\"} %d\n", histogram.name, histogram.label, key, bound, cumulative)
+            }
+
+            _, _ = fmt.Fprintf(&builder, "%s_bucket{%s=%q,le=\"+Inf\"} %d\n", histogram.name, histogram.label, key, entry.count)
+            _, _ = fmt.Fprintf(&builder, "%s_sum{%s=%q} %g\n", histogram.name, histogram.label, key, entry.sum)
+            _, _ = fmt.Fprintf(&builder, "%s_count{%s=%q} %d\n", histogram.name, histogram.label, key, entry.count)
+        }
+    }
+
+    this.mutex.Unlock() // collectors take their own locks
+
+    for _, gauge := range gauges {
+        _, _ = fmt.Fprintf(&builder, "# HELP %s %s\n# TYPE %s gauge\n", gauge.name, gauge.help, gauge.name)
+        values := gauge.collect()
+        for _, key := range sortedKeys(values) {
+            _, _ = fmt.Fprintf(&builder, "%s{%s=%q} %g\n", gauge.name, gauge.label, key, values[key])
+        }
+    }
+
+    return builder.String()
+}
+
+func Serve(host string, port uint) { // doesn't block
+    mux := http.NewServeMux()
+    mux.HandleFunc("/metrics", func(writer http.ResponseWriter, _ *http.Request) {
+        writer.Header().Set("Content-Type", "text/plain; version=0.0.4")
+        _, _ = writer.Write([]byte(expose()))
+    })
+
+    go func() {
+        if err := http.ListenAndServe(fmt.Sprintf("%s:%d", host, port), mux); err != nil { logging.Error("metrics endpoint failed", logging.Err(err)) }
+    }()
+}
@@ -0,0 +1,44 @@
+/*
+ * Exchatge - a secured realtime message exchanger (server).
+ * Copyright (C) 2023-2024  Vadim Nikolaev (https://github.com/vadniks)
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+
+package metrics
+
+import (
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestExposition(t *testing.T) {
+    counter := NewCounter("test_total", "Test counter", "kind")
+    counter.Inc("a")
+    counter.Inc("a")
+
+    histogram := NewLatencyHistogram("test_duration_seconds", "Test histogram", "call")
+    histogram.Observe("b", time.Now())
+
+    SetGauge("test_gauge", "Test gauge", "pool", func() map[string]float64 { return map[string]float64{"c": 0.5} })
+    SetGauge("test_gauge", "Test gauge", "pool", func() map[string]float64 { return map[string]float64{"c": 1} }) // replaces
+
+    exposed := expose()
+    if !strings.Contains(exposed, "# TYPE test_total counter\ntest_total{kind=\"a\"} 2\n") { t.Error() }
+    if !strings.Contains(exposed, "test_duration_seconds_bucket{call=\"b\",le=\"+Inf\"} 1\n") { t.Error() }
+    if !strings.Contains(exposed, "test_duration_seconds_count{call=\"b\"} 1\n") { t.Error() }
+    if !strings.Contains(exposed, "test_gauge{pool=\"c\"} 1\n") || strings.Count(exposed, "# TYPE test_gauge") != 1 { t.Error() }
+}
@@ -0,0 +1,114 @@
+/*
+ * Exchatge - a secured realtime message exchanger (server).
+ * Copyright (C) 2023-2024  Vadim Nikolaev (https://github.com/vadniks)
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+
+package net
+
+import (
+    "ExchatgeServer/crypto"
+    "ExchatgeServer/database"
+    "unsafe"
+)
+
+const (
+    flagChangePassword int32 = 0x00000016 // body: old password, new password
+    flagChangeUsername int32 = 0x00000017 // body: new username; reply body: the same
+    flagDeleteAccount int32 = 0x00000018 // body: password; the connection gets finished after the reply
+)
+
+func (_ *syncT) credentialValid(credential []byte) bool { // username or password, which are padded with zeroes
+    nonZeroes := uint(0)
+    for _, i := range credential { if i != 0 && i != byte(' ') { nonZeroes++ } }
+    return nonZeroes >= minCredentialSize
+}
+
+func (sync *syncT) passwordChangeRequested(connectionId uint32, user *database.User, msg *message) int32 {
+    if msg.body == nil || uint(msg.size) != UnhashedPasswordSize * 2 { return sync.finishWithError(connectionId, reasonMalformedMessage) }
+
+    oldUnhashedPassword := make([]byte, UnhashedPasswordSize)
+    copy(oldUnhashedPassword, unsafe.Slice(&(msg.body[0]), UnhashedPasswordSize))
+
+    newUnhashedPassword := make([]byte, UnhashedPasswordSize)
+    copy(newUnhashedPassword, unsafe.Slice(&(msg.body[UnhashedPasswordSize]), UnhashedPasswordSize))
+
+    if !sync.credentialValid(newUnhashedPassword) {
+        Net.sendMessage(connectionId, sync.errorMessage(flagChangePassword, msg.from))
+        return flagError
+    }
+
+    sync.rwMutex.Lock()
+    changed, err := database.ChangePassword(user, oldUnhashedPassword, crypto.Hash(newUnhashedPassword))
+    sync.rwMutex.Unlock()
+
+    if err != nil { return sync.finishWithError(connectionId, reasonDatabaseFailure) }
+
+    if !changed {
+        Net.sendMessage(connectionId, sync.errorMessage(flagChangePassword, msg.from))
+        return flagError
+    }
+
+    Net.sendMessage(connectionId, sync.simpleServerMessage(flagChangePassword, msg.from))
+    return flagProceed
+}
+
+func (sync *syncT) usernameChangeRequested(connectionId uint32, user *database.User, msg *message) int32 { // the admin's username is fixed
+    if msg.body == nil || uint(msg.size) != usernameSize { return sync.finishWithError(connectionId, reasonMalformedMessage) }
+
+    if database.IsAdmin(user) || !sync.credentialValid(msg.body) {
+        Net.sendMessage(connectionId, sync.errorMessage(flagChangeUsername, msg.from))
+        return flagError
+    }
+
+    sync.rwMutex.Lock()
+    renamed, err := database.RenameUser(user.Id, msg.body)
+    if renamed && err == nil { connections.renameUser(connectionId, msg.body) }
+    sync.rwMutex.Unlock()
+
+    if err != nil { return sync.finishWithError(connectionId, reasonDatabaseFailure) }
+
+    if !renamed {
+        Net.sendMessage(connectionId, sync.errorMessage(flagChangeUsername, msg.from))
+        return flagError
+    }
+
+    Net.sendMessage(connectionId, sync.serverMessage(flagChangeUsername, msg.from, msg.body))
+    return flagProceed
+}
+
+func (sync *syncT) accountDeletionRequested(connectionId uint32, user *database.User, msg *message) int32 { // the admin can't be deleted
+    if msg.body == nil || uint(msg.size) != UnhashedPasswordSize { return sync.finishWithError(connectionId, reasonMalformedMessage) }
+
+    if database.IsAdmin(user) {
+        Net.sendMessage(connectionId, sync.errorMessage(flagDeleteAccount, msg.from))
+        return flagError
+    }
+
+    sync.rwMutex.Lock()
+    deleted, err := database.DeleteUser(user, msg.body)
+    sync.rwMutex.Unlock()
+
+    if err != nil { return sync.finishWithError(connectionId, reasonDatabaseFailure) }
+
+    if !deleted {
+        Net.sendMessage(connectionId, sync.errorMessage(flagDeleteAccount, msg.from))
+        return flagError
+    }
+
+    Net.sendMessage(connectionId, sync.simpleServerMessage(flagDeleteAccount, msg.from))
+    return sync.finishRequested(connectionId) // the only live session of the user as one can't log in twice
+}
@@ -0,0 +1,217 @@
+/*
+ * Exchatge - a secured realtime message exchanger (server).
+ * Copyright (C) 2023-2024  Vadim Nikolaev (https://github.com/vadniks)
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+
+package net
+
+import (
+    "ExchatgeServer/database"
+    "ExchatgeServer/logging"
+    "ExchatgeServer/utils"
+    "fmt"
+    "math"
+    "unsafe"
+)
+
+const (
+    flagKick int32 = 0x00000019 // admin only; body: user id; the kicked user gets the same flag right before disconnection
+    flagBan int32 = 0x0000001a // admin only; body: user id, 1 to ban or 0 to unban; a banned user gets kicked if connected
+    flagLockRegistration int32 = 0x0000001b // admin only; body: 1 to lock or 0 to unlock the registration
+    flagFetchConnections int32 = 0x0000001c // admin only; replies with connectionInfos of all live connections
+    flagPurgeMessages int32 = 0x00000026 // admin only; body: user id, peer id or allPeers; deletes the stored messages of the conversation or all of the user's ones, replies with the body followed by the count of the deleted messages
+
+    allPeers = 0xffffffff
+
+    connectionInfoSize = intSize * 3 + longSize // 20
+)
+
+type connectionInfo struct {
+    connectionId uint32
+    userId uint32 // fromAnonymous if the connection hasn't logged in yet
+    state uint32
+    connectedMillis uint64
+}
+
+//goland:noinspection GoRedundantConversion
+func (_ *netT) packConnectionInfo(xConnectionInfo *connectionInfo) []byte {
+    bytes := make([]byte, connectionInfoSize)
+
+    copy(unsafe.Slice(&(bytes[0]), intSize), unsafe.Slice((*byte) (unsafe.Pointer(&(xConnectionInfo.connectionId))), intSize))
+    copy(unsafe.Slice(&(bytes[intSize]), intSize), unsafe.Slice((*byte) (unsafe.Pointer(&(xConnectionInfo.userId))), intSize))
+    copy(unsafe.Slice(&(bytes[intSize * 2]), intSize), unsafe.Slice((*byte) (unsafe.Pointer(&(xConnectionInfo.state))), intSize))
+    copy(unsafe.Slice(&(bytes[intSize * 3]), longSize), unsafe.Slice((*byte) (unsafe.Pointer(&(xConnectionInfo.connectedMillis))), longSize))
+
+    return bytes
+}
+
+func (_ *syncT) recordAdministrativeAction(admin *database.User, action string) {
+    logging.Info("administrative action", logging.UserId(admin.Id), logging.F("action", action))
+}
+
+func (sync *syncT) kickConnection(connectionId uint32, userId uint32) { // notifies the user, its writer sends what's left and then closes the connection
+    Net.sendMessage(connectionId, sync.simpleServerMessage(flagKick, userId))
+
+    xConnectedUser := connections.getConnectedUser(connectionId)
+    if xConnectedUser == nil { return }
+
+    sync.finishRequested(connectionId)
+    xConnectedUser.outbound.close()
+}
+
+//goland:noinspection GoRedundantConversion
+func (sync *syncT) kickRequested(connectionId uint32, user *database.User, msg *message) int32 {
+    utils.Assert(user != nil)
+    if msg.to != toServer || msg.size != intSize || msg.body == nil { return sync.finishWithError(connectionId, reasonMalformedMessage) }
+    if !database.IsAdmin(user) { return sync.kickUserCuzOfDenialOfAccess(flagKick, connectionId, user.Id) }
+
+    var userId uint32
+    copy(unsafe.Slice((*byte) (unsafe.Pointer(&userId)), intSize), msg.body)
+
+    kickedConnectionId, kickedUser := connections.getAuthorizedConnectedUser(userId)
+    if kickedUser == nil || database.IsAdmin(kickedUser) {
+        Net.sendMessage(connectionId, sync.errorMessage(flagKick, msg.from))
+        return flagError
+    }
+
+    sync.kickConnection(kickedConnectionId, userId)
+    sync.recordAdministrativeAction(user, fmt.Sprintf("kicked user %d", userId))
+
+    Net.sendMessage(connectionId, sync.serverMessage(flagKick, msg.from, msg.body))
+    return flagProceed
+}
+
+//goland:noinspection GoRedundantConversion
+func (sync *syncT) banRequested(connectionId uint32, user *database.User, msg *message) int32 {
+    utils.Assert(user != nil)
+
+    userId, banned, ok := sync.parseIntPair(msg)
+    if msg.to != toServer || !ok || banned > 1 { return sync.finishWithError(connectionId, reasonMalformedMessage) }
+    if !database.IsAdmin(user) { return sync.kickUserCuzOfDenialOfAccess(flagBan, connectionId, user.Id) }
+
+    sync.rwMutex.Lock()
+    updated, err := database.SetUserBanned(userId, banned == 1)
+    sync.rwMutex.Unlock()
+
+    if err != nil { return sync.finishWithError(connectionId, reasonDatabaseFailure) }
+
+    if !updated {
+        Net.sendMessage(connectionId, sync.errorMessage(flagBan, msg.from))
+        return flagError
+    }
+
+    if banned == 1 {
+        if bannedConnectionId, bannedUser := connections.getAuthorizedConnectedUser(userId); bannedUser != nil { sync.kickConnection(bannedConnectionId, userId) }
+        sync.recordAdministrativeAction(user, fmt.Sprintf("banned user %d", userId))
+    } else {
+        sync.recordAdministrativeAction(user, fmt.Sprintf("unbanned user %d", userId))
+    }
+
+    Net.sendMessage(connectionId, sync.serverMessage(flagBan, msg.from, msg.body))
+    return flagProceed
+}
+
+//goland:noinspection GoRedundantConversion
+func (sync *syncT) registrationLockRequested(connectionId uint32, user *database.User, msg *message) int32 {
+    utils.Assert(user != nil)
+    if msg.to != toServer || msg.size != intSize || msg.body == nil { return sync.finishWithError(connectionId, reasonMalformedMessage) }
+    if !database.IsAdmin(user) { return sync.kickUserCuzOfDenialOfAccess(flagLockRegistration, connectionId, user.Id) }
+
+    var locked uint32
+    copy(unsafe.Slice((*byte) (unsafe.Pointer(&locked)), intSize), msg.body)
+    if locked > 1 { return sync.finishWithError(connectionId, reasonMalformedMessage) }
+
+    sync.rwMutex.Lock()
+    sync.registrationLocked = locked == 1
+    sync.rwMutex.Unlock()
+
+    if locked == 1 {
+        sync.recordAdministrativeAction(user, "locked the registration")
+    } else {
+        sync.recordAdministrativeAction(user, "unlocked the registration")
+    }
+
+    Net.sendMessage(connectionId, sync.serverMessage(flagLockRegistration, msg.from, msg.body))
+    return flagProceed
+}
+
+func (sync *syncT) connectionsListRequested(connectionId uint32, user *database.User, msg *message) int32 {
+    utils.Assert(user != nil)
+    if msg.to != toServer || msg.size != 0 { return sync.finishWithError(connectionId, reasonMalformedMessage) }
+    if !database.IsAdmin(user) { return sync.kickUserCuzOfDenialOfAccess(flagFetchConnections, connectionId, user.Id) }
+
+    var infos []connectionInfo
+    connections.doForEachConnection(func(xConnectionId uint32, xConnectedUser *connectedUser) {
+        userId := fromAnonymous
+        if xConnectedUser.user != nil { userId = xConnectedUser.user.Id }
+
+        infos = append(infos, connectionInfo{xConnectionId, userId, uint32(xConnectedUser.state), xConnectedUser.connectedMillis})
+    })
+
+    infosPerMessage := uint32(math.Floor(float64(maxMessageBodySize) / float64(connectionInfoSize)))
+    messagesCount := uint32(math.Ceil(float64(len(infos)) / float64(infosPerMessage))) // at least the admin's connection is there
+
+    for messageIndex := uint32(0); messageIndex < messagesCount; messageIndex++ {
+        var connectionInfosBytes []byte
+
+        for i := messageIndex * infosPerMessage; i < (messageIndex + 1) * infosPerMessage && i < uint32(len(infos)); i++ {
+            connectionInfosBytes = append(connectionInfosBytes, Net.packConnectionInfo(&(infos[i]))...)
+        }
+
+        Net.sendMessageWaiting(connectionId, &message{
+            flag: flagFetchConnections,
+            timestamp: utils.CurrentTimeMillis(),
+            size: uint32(len(connectionInfosBytes)),
+            index: messageIndex,
+            count: messagesCount,
+            from: fromServer,
+            to: msg.from,
+            token: sync.serverToken(),
+            body: connectionInfosBytes,
+        })
+    }
+
+    sync.recordAdministrativeAction(user, "listed the connections")
+    return flagProceed
+}
+
+//goland:noinspection GoRedundantConversion
+func (sync *syncT) messagesPurgeRequested(connectionId uint32, user *database.User, msg *message) int32 {
+    utils.Assert(user != nil)
+
+    userId, peerId, ok := sync.parseIntPair(msg)
+    if msg.to != toServer || !ok { return sync.finishWithError(connectionId, reasonMalformedMessage) }
+    if !database.IsAdmin(user) { return sync.kickUserCuzOfDenialOfAccess(flagPurgeMessages, connectionId, user.Id) }
+
+    var peer *uint32 = nil
+    if peerId != allPeers { peer = &peerId }
+
+    sync.rwMutex.Lock()
+    deleted, err := database.PurgeMessages(userId, peer)
+    sync.rwMutex.Unlock()
+
+    if err != nil { return sync.finishWithError(connectionId, reasonDatabaseFailure) }
+
+    if peer == nil {
+        sync.recordAdministrativeAction(user, fmt.Sprintf("purged %d messages of user %d", deleted, userId))
+    } else {
+        sync.recordAdministrativeAction(user, fmt.Sprintf("purged %d messages between users %d and %d", deleted, userId, peerId))
+    }
+
+    Net.sendMessage(connectionId, sync.serverMessage(flagPurgeMessages, msg.from, append(append([]byte(nil), msg.body...), unsafe.Slice((*byte) (unsafe.Pointer(&deleted)), longSize)...)))
+    return flagProceed
+}
@@ -26,12 +26,86 @@ import (
     goSync "sync"
 )
 
+const outboundSize = 256 // messages
+
+type outgoingMessage struct {
+    msg *message
+    messageSize uint32 // the receiver's one at the moment of queueing, so the frames can't outgrow what the receiver expects, e.g. if a greater size gets granted while the message waits
+}
+
+type outboundT struct { // messages waiting to be sent by the connection's writer
+    messages chan *outgoingMessage // never closed, so that a producer blocked on it can't panic
+    stopped chan struct{} // closed along with the outbound
+    closed bool
+    mutex goSync.Mutex
+}
+
+func makeOutbound() *outboundT { return &outboundT{make(chan *outgoingMessage, outboundSize), make(chan struct{}), false, goSync.Mutex{}} }
+
+func (outbound *outboundT) push(msg *message, messageSize uint32) bool { // doesn't block, returns false if the outbound is full; messages pushed after closing are dropped
+    outbound.mutex.Lock()
+
+    pushed := true
+    if !outbound.closed {
+        select {
+            case outbound.messages <- &outgoingMessage{msg, messageSize}: {}
+            default: pushed = false
+        }
+    }
+
+    outbound.mutex.Unlock()
+    return pushed
+}
+
+func (outbound *outboundT) pushWaiting(msg *message, messageSize uint32) { // blocks while the outbound is full; messages pushed after closing are dropped
+    outbound.mutex.Lock()
+    closed := outbound.closed
+    outbound.mutex.Unlock()
+
+    if closed { return }
+
+    select {
+        case outbound.messages <- &outgoingMessage{msg, messageSize}: {}
+        case <-outbound.stopped: {}
+    }
+}
+
+func (outbound *outboundT) pop() *outgoingMessage { // nillable result; blocks until the next message comes, returns nil once the outbound is closed & emptied
+    select {
+        case outgoing := <-outbound.messages: return outgoing
+        case <-outbound.stopped: {}
+    }
+
+    select { // what's left after closing, e.g. the reason of finishing
+        case outgoing := <-outbound.messages: return outgoing
+        default: return nil
+    }
+}
+
+func (outbound *outboundT) close() {
+    outbound.mutex.Lock()
+
+    if !outbound.closed {
+        outbound.closed = true
+        close(outbound.stopped)
+    }
+
+    outbound.mutex.Unlock()
+}
+
 type connectedUser struct {
     connection *goNet.Conn
-    coders *crypto.Coders
+    coders *crypto.Coders // encoder is used only by the writer, decoder - only by the reader
+    outbound *outboundT
     user *database.User // nillable
     state uint
     connectedMillis uint64
+    messageSize uint32 // negotiated via flagMessageSize
+    sequences *sequencesT
+    roomSequences *sequencesT // room ids may coincide with user ids, so the rooms have their own
+    address string // remote IP, empty if unknown
+    rateLimitViolations uint32 // in a row
+    presenceContacts map[uint32/*userId*/]bool // nillable, nil if not subscribed to presence updates, empty to watch everyone
 }
 
 type connectionsT struct {
@@ -45,21 +119,34 @@ var connections = &connectionsT{ // aka singleton
    goSync.RWMutex{},
 }
 
-func (connections *connectionsT) addNewConnection(connectionId uint32, connection *goNet.Conn, coders *crypto.Coders) {
+func (connections *connectionsT) addNewConnection(connectionId uint32, connection *goNet.Conn, coders *crypto.Coders, outbound *outboundT) *connectedUser {
     connections.rwMutex.Lock()
 
     _, ok := connections.connectedUsers[connectionId]
     utils.Assert(!ok)
 
-    connections.connectedUsers[connectionId] = &connectedUser{
+    xConnectedUser := &connectedUser{
         connection: connection,
         coders: coders,
+        outbound: outbound,
         user: nil,
         state: stateConnected,
         connectedMillis: utils.CurrentTimeMillis(),
+        messageSize: uint32(maxMessageSize),
+        sequences: makeSequences(),
+        roomSequences: makeSequences(),
+        address: "",
+        rateLimitViolations: 0,
+        presenceContacts: nil,
+    }
+
+    if connection != nil {
+        if host, _, err := goNet.SplitHostPort((*connection).RemoteAddr().String()); err == nil { xConnectedUser.address = host }
     }
+    connections.connectedUsers[connectionId] = xConnectedUser
 
     connections.rwMutex.Unlock()
+    return xConnectedUser
 }
 
 func (connections *connectionsT) getConnectedUser(connectionId uint32) *connectedUser { // nillable result
@@ -87,6 +174,61 @@ func (connections *connectionsT) getConnection(connectionId uint32) *goNet.Conn
     return xConnectedUser.connection
 }
 
+func (connections *connectionsT) getMessageSize(connectionId uint32) uint32 { // returns 0 if there's no such connection
+    xConnectedUser := connections.getConnectedUser(connectionId)
+    if xConnectedUser == nil { return 0 }
+    return connections.getUserMessageSize(xConnectedUser)
+}
+
+func (connections *connectionsT) getUserMessageSize(xConnectedUser *connectedUser) uint32 {
+    connections.rwMutex.RLock()
+    size := xConnectedUser.messageSize
+    connections.rwMutex.RUnlock()
+
+    return size
+}
+
+func (connections *connectionsT) setMessageSize(connectionId uint32, size uint32) bool { // returns true on success
+    xConnectedUser := connections.getConnectedUser(connectionId)
+    if xConnectedUser == nil { return false }
+
+    connections.rwMutex.Lock()
+    xConnectedUser.messageSize = size
+    connections.rwMutex.Unlock()
+
+    return true
+}
+
+func (connections *connectionsT) getAddress(connectionId uint32) string { // returns an empty string if there's no such connection
+    xConnectedUser := connections.getConnectedUser(connectionId)
+    if xConnectedUser == nil { return "" }
+    return xConnectedUser.address
+}
+
+func (connections *connectionsT) countRateLimitViolation(connectionId uint32, violated bool) uint32 { // returns violations count in a row, a successful request resets it
+    xConnectedUser := connections.getConnectedUser(connectionId)
+    if xConnectedUser == nil { return 0 }
+    connections.rwMutex.Lock()
+
+    if violated { xConnectedUser.rateLimitViolations++ } else { xConnectedUser.rateLimitViolations = 0 }
+    violations := xConnectedUser.rateLimitViolations
+
+    connections.rwMutex.Unlock()
+    return violations
+}
+
+func (connections *connectionsT) getSequences(connectionId uint32) *sequencesT { // nillable result
+    xConnectedUser := connections.getConnectedUser(connectionId)
+    if xConnectedUser == nil { return nil }
+    return xConnectedUser.sequences
+}
+
+func (connections *connectionsT) getRoomSequences(connectionId uint32) *sequencesT { // nillable result
+    xConnectedUser := connections.getConnectedUser(connectionId)
+    if xConnectedUser == nil { return nil }
+    return xConnectedUser.roomSequences
+}
+
 func (connections *connectionsT) getConnectionState(connectionId uint32) *uint { // nillable result
     xConnectedUser := connections.getConnectedUser(connectionId)
     if xConnectedUser == nil { return nil }
@@ -124,6 +266,27 @@ func (connections *connectionsT) setUser(connectionId uint32, user *database.Use
     *xConnectionId = connectionId
     connections.ids[user.Id] = xConnectionId
 
+    connections.rwMutex.Unlock()
+
+    connections.publishPresence(user.Id, true, 0)
+    return true
+}
+
+func (connections *connectionsT) renameUser(connectionId uint32, username []byte) bool { // returns true on success; replaces the user with an updated copy as the old one may be in use meanwhile
+    xConnectedUser := connections.getConnectedUser(connectionId)
+    if xConnectedUser == nil { return false }
+    connections.rwMutex.Lock()
+
+    if xConnectedUser.user == nil {
+        connections.rwMutex.Unlock()
+        return false
+    }
+
+    user := new(database.User)
+    *user = *(xConnectedUser.user)
+    user.Name = append([]byte(nil), username...)
+    xConnectedUser.user = user
+
     connections.rwMutex.Unlock()
     return true
 }
@@ -176,9 +339,23 @@ func (connections *connectionsT) doForEachConnectedAuthorizedUser(action func (c
     connections.rwMutex.RUnlock()
 }
 
-func (connections *connectionsT) deleteConnection(connectionId uint32) bool { // returns true on success
+func (connections *connectionsT) onlineUserIds() map[uint32]bool {
+    ids := make(map[uint32]bool)
+    connections.doForEachConnectedAuthorizedUser(func(_ uint32, xConnectedUser *connectedUser) { ids[xConnectedUser.user.Id] = true })
+    return ids
+}
+
+func (connections *connectionsT) doForEachConnection(action func (connectionId uint32, xConnectedUser *connectedUser)) { // including the ones which haven't logged in yet
+    connections.rwMutex.RLock()
+
+    for connectionId, xConnectedUser := range connections.connectedUsers { action(connectionId, xConnectedUser) }
+
+    connections.rwMutex.RUnlock()
+}
+
+func (connections *connectionsT) deleteConnection(connectionId uint32) *disconnection { // nillable, returns non-nil if the connection belonged to a logged in user
     xConnectedUser := connections.getConnectedUser(connectionId)
-    if xConnectedUser == nil { return false }
+    if xConnectedUser == nil { return nil }
 
     connections.rwMutex.Lock()
 
@@ -186,5 +363,7 @@ func (connections *connectionsT) deleteConnection(connectionId uint32) bool { //
     if user := xConnectedUser.user; user != nil { delete(connections.ids, user.Id) }
 
     connections.rwMutex.Unlock()
-    return true
+
+    if user := xConnectedUser.user; user != nil { return connections.userDisconnected(user.Id) }
+    return nil
 }
@@ -0,0 +1,72 @@
+/*
+ * Exchatge - a secured realtime message exchanger (server).
+ * Copyright (C) 2023-2024  Vadim Nikolaev (https://github.com/vadniks)
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+
+package net
+
+import (
+    "ExchatgeServer/database"
+    "unsafe"
+)
+
+const flagServiceDegraded int32 = 0x00000021 // body: the original flag; the request needs the database, which is unavailable at the moment, try again later
+
+func requiresDatabase(flag int32) bool { // the rest (relaying, kicking, etc.) keeps working while the database is unavailable
+    switch flag {
+        case flagLogIn: fallthrough
+        case flagRegister: fallthrough
+        case flagResume: fallthrough
+        case flagRevokeResumeTokens: fallthrough
+        case flagFetchUsers: fallthrough
+        case flagSearchUsers: fallthrough
+        case flagSubscribeToPresence: fallthrough
+        case flagFetchMessages: fallthrough
+        case flagAcknowledge: fallthrough
+        case flagRead: fallthrough
+        case flagCreateRoom: fallthrough
+        case flagInviteToRoom: fallthrough
+        case flagRemoveFromRoom: fallthrough
+        case flagLeaveRoom: fallthrough
+        case flagFetchRooms: fallthrough
+        case flagRoomMessage: fallthrough
+        case flagChangePassword: fallthrough
+        case flagChangeUsername: fallthrough
+        case flagDeleteAccount: fallthrough
+        case flagBan: fallthrough
+        case flagEditMessage: fallthrough
+        case flagDeleteMessage: fallthrough
+        case flagPurgeMessages:
+            return true
+        default:
+            return false
+    }
+}
+
+func (_ *syncT) degraded() bool { return !database.Available() }
+
+//goland:noinspection GoRedundantConversion for (*byte) as without this it won't compile
+func (sync *syncT) serviceDegraded(connectionId uint32, originalFlag int32, to uint32) int32 { // logging in is refused along with the connection, others just wait for the database
+    Net.sendMessage(connectionId, sync.serverMessage(flagServiceDegraded, to, append([]byte(nil), unsafe.Slice((*byte) (unsafe.Pointer(&originalFlag)), intSize)...)))
+
+    if originalFlag == flagLogIn || originalFlag == flagRegister || originalFlag == flagResume {
+        sync.finishRequested(connectionId)
+        return flagFinishWithError
+    }
+
+    return flagProceed
+}
@@ -0,0 +1,83 @@
+/*
+ * Exchatge - a secured realtime message exchanger (server).
+ * Copyright (C) 2023-2024  Vadim Nikolaev (https://github.com/vadniks)
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+
+package net
+
+import (
+    "ExchatgeServer/database"
+    xBytes "bytes"
+    "unsafe"
+)
+
+const (
+    flagSearchUsers int32 = 0x00000022 // body: directoryQuery; replies with userInfos sorted by id, the next page starts from the last id + 1, an empty reply means there are no more users
+
+    directoryQuerySize = intSize * 2 + 1/*sizeof(bool)*/ + usernameSize // 25
+    maxDirectoryPageSize = 100
+)
+
+type directoryQuery struct {
+    fromId uint32 // the page cursor
+    pageSize uint32 // up to maxDirectoryPageSize
+    onlineOnly bool
+    prefix [usernameSize]byte // zero-padded, all zeroes match any name
+}
+
+//goland:noinspection GoRedundantConversion
+func (_ *netT) unpackDirectoryQuery(bytes []byte) *directoryQuery { // nillable result
+    if len(bytes) != int(directoryQuerySize) || bytes[intSize * 2] > 1 { return nil }
+
+    query := &directoryQuery{}
+    copy(unsafe.Slice((*byte) (unsafe.Pointer(&(query.fromId))), intSize), bytes[0:intSize])
+    copy(unsafe.Slice((*byte) (unsafe.Pointer(&(query.pageSize))), intSize), bytes[intSize:intSize * 2])
+    query.onlineOnly = bytes[intSize * 2] == 1
+    copy(query.prefix[:], bytes[intSize * 2 + 1:])
+
+    return query
+}
+
+func (sync *syncT) usersSearchRequested(connectionId uint32, msg *message) int32 { // the filtering is done by the database, only the online users' ids are passed to it
+    query := Net.unpackDirectoryQuery(msg.body)
+    if query == nil || query.pageSize == 0 { return sync.finishWithError(connectionId, reasonMalformedMessage) }
+    if query.pageSize > maxDirectoryPageSize { query.pageSize = maxDirectoryPageSize }
+
+    online := connections.onlineUserIds()
+
+    var ids []uint32 = nil
+    if query.onlineOnly {
+        ids = make([]uint32, 0, len(online))
+        for id := range online { ids = append(ids, id) }
+    }
+
+    sync.rwMutex.RLock()
+    users, err := database.FindUsers(xBytes.TrimRight(query.prefix[:], "\x00"), ids, query.fromId, query.pageSize)
+    sync.rwMutex.RUnlock()
+
+    if err != nil { return sync.finishWithError(connectionId, reasonDatabaseFailure) }
+
+    var userInfosBytes []byte
+    for i := range users {
+        xUserInfo := &userInfo{id: users[i].Id, connected: online[users[i].Id], name: [usernameSize]byte{}}
+        copy(xUserInfo.name[:], users[i].Name)
+        userInfosBytes = append(userInfosBytes, Net.packUserInfo(xUserInfo)...)
+    }
+
+    sync.sendRecords(connectionId, flagSearchUsers, msg.from, userInfosBytes, userInfoSize)
+    return flagProceed
+}
@@ -0,0 +1,87 @@
+/*
+ * Exchatge - a secured realtime message exchanger (server).
+ * Copyright (C) 2023-2024  Vadim Nikolaev (https://github.com/vadniks)
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+
+package net
+
+import (
+    "ExchatgeServer/database"
+    "ExchatgeServer/utils"
+)
+
+const (
+    flagEditMessage int32 = 0x00000027 // body: the message's id (see flagMessageIds), the new body; only the sender can edit, the recipient (the members of a room with the room as 'to') gets the same body if online, later - the edited message from the history
+    flagDeleteMessage int32 = 0x00000028 // body: the message's id; only the sender can delete, the recipient gets the same body if online, later - a message without body from the history
+)
+
+func (sync *syncT) messageChangeRequested(connectionId uint32, msg *message) int32 { // either editing or deletion, replies with the id
+    deleting := msg.flag == flagDeleteMessage
+    if msg.size < longSize || msg.body == nil || deleting != (msg.size == longSize) { return sync.finishWithError(connectionId, reasonMalformedMessage) }
+
+    id := Net.unpackId(msg.body)
+
+    var changed *database.Message
+    var err error
+
+    sync.rwMutex.Lock()
+    if deleting {
+        changed, err = database.DeleteMessage(msg.from, id)
+    } else {
+        changed, err = database.EditMessage(msg.from, id, msg.body[longSize:])
+    }
+
+    var recipients []uint32 = nil
+    to := uint32(0)
+    if changed != nil && err == nil {
+        if changed.Room > 0 {
+            recipients, err = database.GetRoomMembers(changed.Room)
+            to = changed.Room
+        } else {
+            recipients, to = []uint32{changed.To}, changed.To
+        }
+    }
+    sync.rwMutex.Unlock()
+
+    if err != nil { return sync.finishWithError(connectionId, reasonDatabaseFailure) }
+
+    if changed == nil {
+        Net.sendMessage(connectionId, sync.errorMessage(msg.flag, msg.from))
+        return flagError
+    }
+
+    for _, recipient := range recipients {
+        if recipient == msg.from { continue }
+
+        if recipientConnectionId, recipientUser := connections.getAuthorizedConnectedUser(recipient); recipientUser != nil {
+            Net.sendMessage(recipientConnectionId, &message{
+                flag: msg.flag,
+                timestamp: utils.CurrentTimeMillis(),
+                size: msg.size,
+                index: 0,
+                count: 1,
+                from: msg.from,
+                to: to,
+                token: sync.serverToken(),
+                body: msg.body,
+            })
+        }
+    }
+
+    Net.sendMessage(connectionId, sync.serverMessage(msg.flag, msg.from, msg.body[:longSize]))
+    return flagProceed
+}
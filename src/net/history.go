@@ -0,0 +1,124 @@
+/*
+ * Exchatge - a secured realtime message exchanger (server).
+ * Copyright (C) 2023-2024  Vadim Nikolaev (https://github.com/vadniks)
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+
+package net
+
+import (
+    "ExchatgeServer/database"
+    "math"
+    "unsafe"
+)
+
+const (
+    fetchModeConversation = 2 // the first byte of flagFetchMessages' body, 0 & 1 are the messages for the user & from the given user after the timestamp
+    fetchModeRoom = 3 // the same query as for a conversation, the peer is a room of the user
+
+    conversationQuerySize = 1 + intSize + longSize * 4 + intSize // 41
+    maxConversationPageSize = 100
+)
+
+type conversationQuery struct { // 'before' pages go back through the history (the latest messages if both cursors are 0), 'after' pages - forward; a cursor is a (timestamp, id) pair of a message, see flagMessageIds
+    room bool // fetchModeRoom
+    peer uint32
+    afterTimestamp uint64 // 0 - no lower bound
+    afterId uint64 // 0 - after the whole millisecond
+    beforeTimestamp uint64 // 0 - no upper bound
+    beforeId uint64 // 0 - before the whole millisecond
+    limit uint32 // up to maxConversationPageSize
+}
+
+//goland:noinspection GoRedundantConversion
+func (_ *netT) unpackConversationQuery(bytes []byte) *conversationQuery { // nillable result
+    if len(bytes) != int(conversationQuerySize) || bytes[0] != fetchModeConversation && bytes[0] != fetchModeRoom { return nil }
+
+    query := &conversationQuery{room: bytes[0] == fetchModeRoom}
+    copy(unsafe.Slice((*byte) (unsafe.Pointer(&(query.peer))), intSize), bytes[1:])
+    copy(unsafe.Slice((*byte) (unsafe.Pointer(&(query.afterTimestamp))), longSize), bytes[1 + intSize:])
+    copy(unsafe.Slice((*byte) (unsafe.Pointer(&(query.afterId))), longSize), bytes[1 + intSize + longSize:])
+    copy(unsafe.Slice((*byte) (unsafe.Pointer(&(query.beforeTimestamp))), longSize), bytes[1 + intSize + longSize * 2:])
+    copy(unsafe.Slice((*byte) (unsafe.Pointer(&(query.beforeId))), longSize), bytes[1 + intSize + longSize * 3:])
+    copy(unsafe.Slice((*byte) (unsafe.Pointer(&(query.limit))), intSize), bytes[1 + intSize + longSize * 4:])
+
+    return query
+}
+
+func (sync *syncT) conversationRequested(connectionId uint32, msg *message) int32 { // replies the same way as the other fetch modes do: a message per stored one, sorted by timestamp, or the query itself if there are none
+    query := Net.unpackConversationQuery(msg.body)
+    if query == nil || query.limit == 0 || !query.room && query.peer >= sync.maxUsersCount { return sync.finishWithError(connectionId, reasonMalformedMessage) }
+    if query.limit > maxConversationPageSize { query.limit = maxConversationPageSize }
+
+    if query.room {
+        sync.rwMutex.RLock()
+        room, flag := sync.findRoomOfMember(connectionId, query.peer, msg.from)
+        sync.rwMutex.RUnlock()
+
+        if flag == flagFinishWithError { return flag }
+
+        if room == nil {
+            Net.sendMessage(connectionId, sync.errorMessage(flagFetchMessages, msg.from))
+            return flagError
+        }
+    } else {
+        exists, err := database.UserExists(query.peer)
+        if err != nil { return sync.finishWithError(connectionId, reasonDatabaseFailure) }
+
+        if !exists {
+            Net.sendMessage(connectionId, sync.errorMessage(flagFetchMessages, msg.from))
+            return flagError
+        }
+    }
+
+    after := database.MessageCursor{Timestamp: query.afterTimestamp, Id: query.afterId}
+    if after.Id == 0 { after.Id = math.MaxUint64 }
+
+    before := database.MessageCursor{Timestamp: query.beforeTimestamp, Id: query.beforeId}
+    if before.Timestamp == 0 { before = database.MessageCursor{Timestamp: math.MaxUint64, Id: math.MaxUint64} }
+
+    latest := query.beforeTimestamp != 0 || query.afterTimestamp == 0
+
+    var messages []database.Message
+    var err error
+
+    sync.rwMutex.RLock()
+    if query.room {
+        messages, err = database.GetRoomMessages(query.peer, after, before, query.limit, latest)
+    } else {
+        messages, err = database.GetConversation(msg.from, query.peer, after, before, query.limit, latest)
+    }
+    sync.rwMutex.RUnlock()
+
+    if err != nil { return sync.finishWithError(connectionId, reasonDatabaseFailure) }
+
+    if len(messages) == 0 {
+        Net.sendMessage(connectionId, sync.serverMessage(flagFetchMessages, msg.from, append([]byte(nil), msg.body...)))
+        return flagProceed
+    }
+
+    for index := range messages {
+        xMessage := &(messages[index])
+
+        to := xMessage.To
+        if xMessage.Room > 0 { to = xMessage.Room }
+
+        Net.sendMessageWaiting(connectionId, sync.storedMessage(flagFetchMessages, xMessage, uint32(index), uint32(len(messages)), to))
+    }
+
+    sync.sendMessageIds(connectionId, msg.from, messages)
+    return sync.messagesDelivered(connectionId, msg.from, messages)
+}
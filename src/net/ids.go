@@ -0,0 +1,72 @@
+/*
+ * Exchatge - a secured realtime message exchanger (server).
+ * Copyright (C) 2023-2024  Vadim Nikolaev (https://github.com/vadniks)
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+
+package net
+
+import (
+    "ExchatgeServer/database"
+    "ExchatgeServer/utils"
+    "unsafe"
+)
+
+const (
+    flagMessageIds int32 = 0x0000002b // server-only; body consists of messageId records: acknowledges a stored message to its sender, follows a relayed one & each batch of the fetched or pushed ones
+
+    messageIdSize = intSize * 2 + longSize * 2 // 24
+)
+
+type messageId struct { // binds a message, as clients see it, to its server-assigned id
+    from uint32
+    to uint32 // the room for room messages
+    timestamp uint64 // as it has been sent
+    id uint64
+}
+
+//goland:noinspection GoRedundantConversion
+func (_ *netT) packMessageIds(messages []database.Message) []byte { // messages stored before the ids were introduced are skipped as they have none
+    bytes := make([]byte, 0, len(messages) * int(messageIdSize))
+
+    for i := range messages {
+        xMessage := &(messages[i])
+        if xMessage.Id == 0 { continue }
+
+        record := messageId{xMessage.From, xMessage.To, xMessage.Timestamp, xMessage.Id}
+        if xMessage.Room > 0 { record.to = xMessage.Room } // as the members see it
+        bytes = append(bytes, unsafe.Slice((*byte) (unsafe.Pointer(&(record.from))), intSize)...)
+        bytes = append(bytes, unsafe.Slice((*byte) (unsafe.Pointer(&(record.to))), intSize)...)
+        bytes = append(bytes, unsafe.Slice((*byte) (unsafe.Pointer(&(record.timestamp))), longSize)...)
+        bytes = append(bytes, unsafe.Slice((*byte) (unsafe.Pointer(&(record.id))), longSize)...)
+    }
+
+    return bytes
+}
+
+//goland:noinspection GoRedundantConversion
+func (_ *netT) unpackId(bytes []byte) uint64 { // of a message, from the beginning of the bytes
+    utils.Assert(len(bytes) >= longSize)
+
+    var id uint64
+    copy(unsafe.Slice((*byte) (unsafe.Pointer(&id)), longSize), bytes[:longSize])
+    return id
+}
+
+func (sync *syncT) sendMessageIds(connectionId uint32, to uint32, messages []database.Message) { // sends nothing if none of the messages has an id
+    records := Net.packMessageIds(messages)
+    if len(records) > 0 { sync.sendRecords(connectionId, flagMessageIds, to, records, uint(messageIdSize)) }
+}
@@ -0,0 +1,46 @@
+/*
+ * Exchatge - a secured realtime message exchanger (server).
+ * Copyright (C) 2023-2024  Vadim Nikolaev (https://github.com/vadniks)
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+
+package net
+
+import (
+    "ExchatgeServer/crypto"
+    "ExchatgeServer/utils"
+)
+
+const flagSignKeys int32 = 0x00000020 // body: crypto.MakeSignKeysAnnouncement, the signing keys rotation state; can be requested before logging in
+
+func (sync *syncT) signKeysRequested(connectionId uint32, msg *message) int32 {
+    if msg.size != 0 { return sync.finishWithError(connectionId, reasonMalformedMessage) }
+
+    announcement := crypto.MakeSignKeysAnnouncement()
+
+    Net.sendMessage(connectionId, &message{
+        flag: flagSignKeys,
+        timestamp: utils.CurrentTimeMillis(),
+        size: uint32(len(announcement)),
+        index: 0,
+        count: 1,
+        from: fromServer,
+        to: msg.from,
+        token: sync.serverToken(),
+        body: announcement[:],
+    })
+    return flagProceed
+}
@@ -0,0 +1,152 @@
+/*
+ * Exchatge - a secured realtime message exchanger (server).
+ * Copyright (C) 2023-2024  Vadim Nikolaev (https://github.com/vadniks)
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+
+package net
+
+import (
+    "ExchatgeServer/logging"
+    "ExchatgeServer/utils"
+    "fmt"
+    goSync "sync"
+    "unsafe"
+)
+
+const (
+    flagRateLimited int32 = 0x0000001f // body: the original flag & milliseconds to wait before the next request of that kind
+
+    rateClassMessages = 0 // everything which isn't listed below: messages, acknowledgements, rooms & account management...
+    rateClassQueries = 1 // fetching users, messages, rooms & connections, each hits the database
+    rateClassAuthentication = 2 // logging in, registration & resuming
+    rateClassesCount = 3
+
+    ipBucketsFactor = 4 // several clients may share an address (e.g. behind the NAT), so buckets keyed by IP are larger and refill faster
+    maxRateLimitViolations = 5 // in a row, then the connection gets finished
+    bucketsCleanupInterval = 60000 // milliseconds
+)
+
+type RateLimit struct {
+    PerSecond uint // tokens refilled each second
+    Burst uint // bucket size
+}
+
+type bucketT struct {
+    tokens float64
+    perSecond float64
+    lastMillis uint64
+}
+
+type rateLimitsT struct { // token buckets keyed by connection, user id & remote address, each request takes a token from each of its class' buckets
+    limits [rateClassesCount]RateLimit
+    buckets map[string]*bucketT
+    lastCleanupMillis uint64
+    mutex goSync.Mutex
+}
+
+func makeRateLimits(limits [rateClassesCount]RateLimit) *rateLimitsT {
+    for _, limit := range limits { utils.Assert(limit.PerSecond > 0 && limit.Burst > 0) }
+    return &rateLimitsT{limits, make(map[string]*bucketT), utils.CurrentTimeMillis(), goSync.Mutex{}}
+}
+
+func rateClassOf(flag int32) int {
+    switch flag {
+        case flagFetchUsers: fallthrough
+        case flagSearchUsers: fallthrough
+        case flagSubscribeToPresence: fallthrough
+        case flagFetchMessages: fallthrough
+        case flagFetchRooms: fallthrough
+        case flagFetchConnections: fallthrough
+        case flagSignKeys:
+            return rateClassQueries
+        case flagLogIn: fallthrough
+        case flagRegister: fallthrough
+        case flagResume:
+            return rateClassAuthentication
+        default:
+            return rateClassMessages
+    }
+}
+
+func isRateLimited(msg *message) bool { // a multipart message takes a token only with its first part, the rest are validated against it by the sequences, so dropping them would break the sequence
+    return msg.flag != flagProceed && msg.flag != flagRoomMessage || msg.index == 0
+}
+
+func (rateLimits *rateLimitsT) refill(key string, perSecond float64, burst float64, now uint64) *bucketT { // must be called with the mutex locked
+    bucket, ok := rateLimits.buckets[key]
+    if !ok {
+        bucket = &bucketT{burst, perSecond, now}
+        rateLimits.buckets[key] = bucket
+        return bucket
+    }
+
+    bucket.tokens += float64(now - bucket.lastMillis) * perSecond / 1000
+    if bucket.tokens > burst { bucket.tokens = burst }
+    bucket.lastMillis = now
+
+    return bucket
+}
+
+func (rateLimits *rateLimitsT) cleanup(now uint64) { // must be called with the mutex locked; a full bucket is the same as a missing one
+    if now - rateLimits.lastCleanupMillis < bucketsCleanupInterval { return }
+    rateLimits.lastCleanupMillis = now
+
+    for key, bucket := range rateLimits.buckets {
+        if now - bucket.lastMillis >= bucketsCleanupInterval { delete(rateLimits.buckets, key) } // as the slowest refill is 1 token per second
+    }
+}
+
+func (rateLimits *rateLimitsT) take(flag int32, connectionId uint32, userId *uint32 /*nillable*/, address string) uint32 { // returns 0 if allowed, otherwise the time in milliseconds to wait for the next token
+    class := rateClassOf(flag)
+    limit := rateLimits.limits[class]
+    perSecond, burst := float64(limit.PerSecond), float64(limit.Burst)
+
+    rateLimits.mutex.Lock()
+    now := utils.CurrentTimeMillis()
+    rateLimits.cleanup(now)
+
+    buckets := []*bucketT{rateLimits.refill(fmt.Sprintf("%d:c%d", class, connectionId), perSecond, burst, now)}
+    if userId != nil { buckets = append(buckets, rateLimits.refill(fmt.Sprintf("%d:u%d", class, *userId), perSecond, burst, now)) }
+    if len(address) > 0 { buckets = append(buckets, rateLimits.refill(fmt.Sprintf("%d:a%s", class, address), perSecond * ipBucketsFactor, burst * ipBucketsFactor, now)) }
+
+    waitMillis := uint32(0)
+    for _, bucket := range buckets {
+        if bucket.tokens >= 1 { continue }
+        if wait := uint32((1 - bucket.tokens) * 1000 / bucket.perSecond) + 1; wait > waitMillis { waitMillis = wait }
+    }
+
+    if waitMillis == 0 { for _, bucket := range buckets { bucket.tokens-- } } // tokens are taken only if every bucket has one
+
+    rateLimits.mutex.Unlock()
+    return waitMillis
+}
+
+//goland:noinspection GoRedundantConversion
+func (sync *syncT) rateLimitExceeded(connectionId uint32, originalFlag int32, waitMillis uint32) int32 { // the request is dropped, the client is told how long to wait
+    if connections.countRateLimitViolation(connectionId, true) >= maxRateLimitViolations { return sync.finishWithError(connectionId, reasonRateLimited) }
+
+    to := toAnonymous
+    if userId := connections.getConnectedUserId(connectionId); userId != nil { to = *userId }
+
+    logging.Info("rate limit exceeded", logging.ConnectionId(connectionId), logging.UserId(to), logging.Flag(originalFlag), logging.F("waitMillis", waitMillis))
+    body := make([]byte, intSize * 2)
+    copy(body, unsafe.Slice((*byte) (unsafe.Pointer(&originalFlag)), intSize))
+    copy(unsafe.Slice(&(body[intSize]), intSize), unsafe.Slice((*byte) (unsafe.Pointer(&waitMillis)), intSize))
+
+    Net.sendMessage(connectionId, sync.serverMessage(flagRateLimited, to, body))
+    return flagError
+}
@@ -21,8 +21,11 @@ package net
 import (
     "ExchatgeServer/crypto"
     "ExchatgeServer/idsPool"
+    "ExchatgeServer/logging"
+    "ExchatgeServer/metrics"
     "ExchatgeServer/utils"
     "fmt"
+    "io"
     goNet "net"
     goSync "sync"
     "sync/atomic"
@@ -33,19 +36,27 @@ import (
 const intSize = 4
 const longSize = 8
 
-const maxMessageSize uint = 1 << 8 // 256
+const maxMessageSize uint = 1 << 8 // 256 - every client supports it, larger sizes are negotiated per connection via flagMessageSize
 const messageHeadSize = intSize * 6 + longSize + crypto.TokenSize // 96
 const maxMessageBodySize = maxMessageSize - messageHeadSize // 160
 const userInfoSize = intSize + 1/*sizeof(bool)*/ + usernameSize // 21
 
 const timeout = 5000 // milliseconds
 
+var routedMessages = metrics.NewCounter("exchatge_routed_messages_total", "Messages routed by flag", "flag")
+var handshakeFailures = metrics.NewCounter("exchatge_handshake_failures_total", "Failed handshakes by stage", "stage")
+
+var stateNames = map[uint]string{stateConnected: "connected", stateSecureConnectionEstablished: "secureConnectionEstablished", stateLoggedWithCredentials: "loggedWithCredentials"}
+
 type netT struct {
     maxTimeMillisToPreserveActiveConnection uint64
     maxTimeMillisIntervalBetweenMessages uint64
-    serverPublicKey []byte
-    serverSecretKey []byte
     connectionIdsPool *idsPool.IdsPool
+    maxNegotiableMessageSize uint32
+    maxMultipartMessageSize uint32 // total size of bodies of all parts
+    reassembleMessages bool
+    maxTimeMillisToPreserveResumeToken uint64
+    rateLimits *rateLimitsT
 }
 var Net *netT = nil // aka singleton
 
@@ -74,7 +85,7 @@ func (net *netT) packMessage(msg *message) []byte {
     utils.Assert(msg != nil)
 
     utils.Assert(msg.body == nil && msg.size == 0 ||
-        msg.body != nil && msg.size != 0 && uint32(len(msg.body)) == msg.size && msg.size <= uint32(maxMessageBodySize))
+        msg.body != nil && msg.size != 0 && uint32(len(msg.body)) == msg.size)
 
     bytes := make([]byte, net.wholeMessageBytesSize(msg.size))
 
@@ -92,8 +103,8 @@ func (net *netT) packMessage(msg *message) []byte {
 }
 
 //goland:noinspection GoRedundantConversion (*byte) - won't compile without casting
-func (_ *netT) unpackMessage(bytes []byte) *message {
-    utils.Assert(len(bytes) > 0)
+func (net *netT) unpackMessage(bytes []byte, maxBodySize uint32) *message { // nillable result, nil if the message is malformed
+    if uint(len(bytes)) < messageHeadSize { return nil }
     msg := new(message)
 
     copy(unsafe.Slice((*byte) (unsafe.Pointer(&(msg.flag))), intSize), unsafe.Slice(&(bytes[0]), intSize))
@@ -105,7 +116,7 @@ func (_ *netT) unpackMessage(bytes []byte) *message {
     copy(unsafe.Slice((*byte) (unsafe.Pointer(&(msg.to))), intSize), unsafe.Slice(&(bytes[intSize * 5 + longSize]), intSize))
     copy(unsafe.Slice((*byte) (unsafe.Pointer(&(msg.token))), crypto.TokenSize), unsafe.Slice(&(bytes[intSize * 6 + longSize]), crypto.TokenSize))
 
-    utils.Assert(msg.size <= uint32(maxMessageBodySize))
+    if msg.size > maxBodySize || uint32(len(bytes)) < net.wholeMessageBytesSize(msg.size) { return nil }
     if msg.size > 0 {
         msg.body = make([]byte, msg.size)
         copy(unsafe.Slice(&(msg.body[0]), msg.size), unsafe.Slice(&(bytes[messageHeadSize]), msg.size))
@@ -128,22 +139,47 @@ func (_ *netT) packUserInfo(xUserInfo *userInfo) []byte {
     return bytes
 }
 
-func Initialize(maxUsersCount uint, maxTimeMillisToPreserveActiveConnection uint, maxTimeMillisIntervalBetweenMessages uint) {
+func Initialize(
+    maxUsersCount uint,
+    maxTimeMillisToPreserveActiveConnection uint,
+    maxTimeMillisIntervalBetweenMessages uint,
+    maxNegotiableMessageSize uint,
+    maxMultipartMessageSize uint,
+    reassembleMessages bool,
+    maxTimeMillisToPreserveResumeToken uint,
+    messagesRateLimit RateLimit,
+    queriesRateLimit RateLimit,
+    authenticationRateLimit RateLimit,
+) {
     var byteOrderChecker uint64 = 0x0123456789abcdef // only on x64 littleEndian data marshalling will work as clients expect
     utils.Assert(unsafe.Sizeof(uintptr(0)) == 8 && *((*uint8) (unsafe.Pointer(&byteOrderChecker))) == 0xef)
 
-    serverPublicKey, serverSecretKey := crypto.GenerateServerKeys()
+    connectionIdsPool := idsPool.InitIdsPool(uint32(maxUsersCount))
 
     utils.Assert(Net == nil)
     Net = &netT{
         uint64(maxTimeMillisToPreserveActiveConnection),
         uint64(maxTimeMillisIntervalBetweenMessages),
-        serverPublicKey,
-        serverSecretKey,
-        idsPool.InitIdsPool(uint32(maxUsersCount)),
+        connectionIdsPool,
+        uint32(maxNegotiableMessageSize),
+        uint32(maxMultipartMessageSize),
+        reassembleMessages,
+        uint64(maxTimeMillisToPreserveResumeToken),
+        makeRateLimits([rateClassesCount]RateLimit{messagesRateLimit, queriesRateLimit, authenticationRateLimit}),
     }
 
     syncInitialize(maxUsersCount)
+
+    metrics.SetGauge("exchatge_connections", "Active connections by state", "state", func() map[string]float64 {
+        byState := map[string]float64{"connected": 0, "secureConnectionEstablished": 0, "loggedWithCredentials": 0}
+        connections.doForEachConnection(func(_ uint32, xConnectedUser *connectedUser) { byState[stateNames[xConnectedUser.state]]++ })
+        return byState
+    })
+
+    metrics.SetGauge("exchatge_connection_ids_pool_occupancy", "Taken connection ids", "pool", func() map[string]float64 {
+        taken, size := connectionIdsPool.Occupancy()
+        return map[string]float64{"connections": float64(taken) / float64(size)}
+    })
 }
 
 func (net *netT) ProcessClients(host string, port uint) {
@@ -184,90 +220,94 @@ func (net *netT) ProcessClients(host string, port uint) {
 
 func (_ *netT) sendDenialOfService(listener goNet.Listener) {
     connection, err := listener.Accept()
-    utils.Assert(err == nil)
+    if err != nil { return }
 
     Net.send(&connection, crypto.Sign(make([]byte, crypto.KeySize)))
-
-    err = connection.Close()
-    utils.Assert(err == nil)
+    _ = connection.Close()
 }
 
 func (_ *netT) watchConnectionTimeouts(acceptingClients *atomic.Bool) {
     for acceptingClients.Load() {
         connections.checkConnectionTimeouts(func(xConnectedUser *connectedUser) {
-            utils.Assert((*(xConnectedUser.connection)).SetDeadline(time.UnixMilli(int64(utils.CurrentTimeMillis() + 100))) == nil)
+            _ = (*(xConnectedUser.connection)).Close() // the connection's reader will fail and finish the connection
         })
         time.Sleep(1e8) // 100 milliseconds = 100 * 1000 000 nanoseconds = 0.1 seconds
     }
 }
 
 func (_ *netT) updateConnectionIdleTimeout(connection *goNet.Conn) {
-    err := (*connection).SetDeadline(time.UnixMilli(int64(utils.CurrentTimeMillis()) + int64(Net.maxTimeMillisIntervalBetweenMessages)))
-    utils.Assert(err == nil)
+    _ = (*connection).SetDeadline(time.UnixMilli(int64(utils.CurrentTimeMillis()) + int64(Net.maxTimeMillisIntervalBetweenMessages))) // the connection may be already closed by the other side, the next read will report it
 }
 
 func (net *netT) processClient(connection *goNet.Conn, connectionId uint32, waitGroup *goSync.WaitGroup, onShutDownRequested *func()) {
     utils.Assert(waitGroup != nil && onShutDownRequested != nil)
-    println("connection ", connectionId, " connected")
+    address := (*connection).RemoteAddr().String()
+    logging.Info("connection accepted", logging.ConnectionId(connectionId), logging.Address(address))
 
     net.updateConnectionIdleTimeout(connection)
 
+    var outbound *outboundT = nil
+    var writerDone chan struct{} = nil
+
+    closed := false
     closeConnection := func(disconnectedByClient bool) {
+        if closed { return }
+        closed = true
+
         if disconnectedByClient {
-            utils.Assert(connections.getConnectedUser(connectionId) != nil)
-            connections.deleteConnection(connectionId)
+            sync.storeLastSeen(connections.deleteConnection(connectionId))
         } else {
             utils.Assert(connections.getConnectedUser(connectionId) == nil)
         }
 
-        net.connectionIdsPool.ReturnId(connectionId)
-        waitGroup.Done()
+        if writerDone != nil { // let the writer send what's left, e.g. the reason of finishing
+            outbound.close()
+            _ = (*connection).SetWriteDeadline(time.UnixMilli(int64(utils.CurrentTimeMillis()) + int64(timeout)))
+            <-writerDone
 
-        utils.Assert((*connection).Close() == nil)
-        println("connection ", connectionId, " disconnected")
-    }
+            _ = (*connection).SetReadDeadline(time.UnixMilli(int64(utils.CurrentTimeMillis()) + int64(timeout)))
+            _, _ = io.Copy(io.Discard, *connection) // closing with unread data resets the connection and the client may lose what has been sent to it, so wait for the client to close its side
+        }
 
-    net.send(connection, crypto.Sign(net.serverPublicKey))
+        net.connectionIdsPool.ReturnId(connectionId)
+        waitGroup.Done()
 
-    clientPublicKey := make([]byte, crypto.KeySize)
-    if !net.receive(connection, clientPublicKey, nil) {
-        closeConnection(false)
-        return
+        _ = (*connection).Close()
+        logging.Info("connection closed", logging.ConnectionId(connectionId), logging.F("byClient", disconnectedByClient))
     }
 
-    serverKey, clientKey := crypto.ExchangeKeys(net.serverPublicKey, net.serverSecretKey, clientPublicKey)
-    if serverKey == nil || clientKey == nil {
-        closeConnection(false)
-        return
-    }
-
-    serverStreamHeader, coders := crypto.CreateEncoderStream(serverKey)
-    encryptedServerStreamHeader := crypto.EncryptSingle(serverStreamHeader, serverKey)
-    utils.Assert(encryptedServerStreamHeader != nil)
-    net.send(connection, encryptedServerStreamHeader)
+    defer func() { // a failure while serving one client mustn't take down the others
+        if recovered := recover(); recovered != nil {
+            logging.Error("connection crashed", logging.ConnectionId(connectionId), logging.F("panic", fmt.Sprint(recovered)))
+            closeConnection(true)
+        }
+    }()
 
-    encryptedClientStreamHeader := make([]byte, crypto.EncryptedSingleSize(crypto.HeaderSize))
-    if !net.receive(connection, encryptedClientStreamHeader, nil) {
+    coders, failedStage := net.shakeHands(connection)
+    if coders == nil {
+        handshakeFailures.Inc(failedStage)
+        logging.Warning("handshake failed", logging.ConnectionId(connectionId), logging.Address(address), logging.F("stage", failedStage))
         closeConnection(false)
         return
     }
 
-    clientStreamHeader := crypto.DecryptSingle(encryptedClientStreamHeader, clientKey)
-    if clientKey == nil {
-        closeConnection(false)
-        return
-    }
+    logging.Debug("handshake completed", logging.ConnectionId(connectionId), logging.Address(address))
 
-    if !coders.CreateDecoderStream(clientKey, clientStreamHeader) {
-        closeConnection(false)
-        return
-    }
+    outbound = makeOutbound()
+    writerDone = make(chan struct{})
 
-    connections.addNewConnection(connectionId, connection, coders)
-    for {
+    go net.writeMessages(connectionId, connections.addNewConnection(connectionId, connection, coders, outbound), writerDone)
+    for { // blocks on reading until the next message comes
         disconnected := false
 
-        if messageBuffer := net.receiveEncryptedMessageBytes(connection, &disconnected); messageBuffer != nil {
+        messageBuffer, validSize := net.receiveEncryptedMessageBytes(connection, connections.getMessageSize(connectionId), &disconnected)
+        if !validSize {
+            sync.finishWithError(connectionId, reasonMalformedMessage)
+            closeConnection(false)
+            return
+        }
+
+        if messageBuffer != nil {
             switch net.processEncryptedClientMessage(connectionId, messageBuffer) {
                 case flagFinishToReconnect: fallthrough
                 case flagFinishWithError: fallthrough
@@ -286,24 +326,63 @@ func (net *netT) processClient(connection *goNet.Conn, connectionId uint32, wait
             closeConnection(true)
             return
         }
+    }
+}
+
+func (net *netT) shakeHands(connection *goNet.Conn) (*crypto.Coders, string) { // nillable first result, returns the stage which has failed otherwise
+    serverPublicKey, serverSecretKey := crypto.GenerateServerKeys() // ephemeral, so a leaked key compromises only one session, not every recorded one
+    net.send(connection, crypto.Sign(serverPublicKey))
 
-        time.Sleep(1e7 * 5) // 0.05 seconds
+    clientPublicKey := make([]byte, crypto.KeySize)
+    if !net.receive(connection, clientPublicKey, nil) {
+        crypto.Wipe(serverSecretKey)
+        return nil, "publicKey"
+    }
+
+    serverKey, clientKey := crypto.ExchangeKeys(serverPublicKey, serverSecretKey, clientPublicKey)
+    crypto.Wipe(serverSecretKey)
+    if serverKey == nil || clientKey == nil { return nil, "keyExchange" }
+
+    wipeSessionKeys := func() { crypto.Wipe(serverKey); crypto.Wipe(clientKey) } // the streams keep their own state
+
+    serverStreamHeader, coders := crypto.CreateEncoderStream(serverKey)
+    encryptedServerStreamHeader := crypto.EncryptSingle(serverStreamHeader, serverKey)
+    utils.Assert(encryptedServerStreamHeader != nil)
+    net.send(connection, encryptedServerStreamHeader)
+
+    encryptedClientStreamHeader := make([]byte, crypto.EncryptedSingleSize(crypto.HeaderSize))
+    if !net.receive(connection, encryptedClientStreamHeader, nil) {
+        wipeSessionKeys()
+        return nil, "streamHeader"
+    }
+
+    clientStreamHeader := crypto.DecryptSingle(encryptedClientStreamHeader, clientKey)
+    if len(clientStreamHeader) != int(crypto.HeaderSize) {
+        wipeSessionKeys()
+        return nil, "streamHeader"
     }
+
+    created := coders.CreateDecoderStream(clientKey, clientStreamHeader)
+    wipeSessionKeys()
+    if !created { return nil, "decoderStream" }
+
+    return coders, ""
 }
 
-func (net *netT) send(connection *goNet.Conn, payload []byte) {
+func (net *netT) send(connection *goNet.Conn, payload []byte) bool { // returns true on success
     utils.Assert(connection != nil && len(payload) > 0)
 
     count, err := (*connection).Write(payload)
-    utils.Assert(count == len(payload) && err == nil) // TODO: remove assert - just ignore // if !-first- || !-second- { return }
+    if count != len(payload) || err != nil { return false } // the receiver's goroutine will notice the broken connection and close it
 
     net.updateConnectionIdleTimeout(connection)
+    return true
 }
 
 func (net *netT) receive(connection *goNet.Conn, buffer []byte, /*nillable*/ error *bool) bool {
     utils.Assert(connection != nil && len(buffer) > 0)
 
-    count, err := (*connection).Read(buffer)
+    count, err := io.ReadFull(*connection, buffer)
     if error != nil { *error = err != nil }
     if err != nil { return false }
 
@@ -313,50 +392,109 @@ func (net *netT) receive(connection *goNet.Conn, buffer []byte, /*nillable*/ err
 }
 
 func (_ *netT) setConnectionTimeoutBetweenMessageParts(connection *goNet.Conn) {
-    err := (*connection).SetDeadline(time.UnixMilli(int64(utils.CurrentTimeMillis()) + int64(timeout))) // wait for $timeout, which is less than used in updateIdleTimeout, as right after the size the actual message must come, timeout then will be reset to default by receive()
-    utils.Assert(err == nil)
+    _ = (*connection).SetDeadline(time.UnixMilli(int64(utils.CurrentTimeMillis()) + int64(timeout))) // wait for $timeout, which is less than used in updateIdleTimeout, as right after the size the actual message must come, timeout then will be reset to default by receive()
 }
 
 //goland:noinspection GoRedundantConversion
-func (net *netT) receiveEncryptedMessageBytes(connection *goNet.Conn, error *bool) []byte { // nillable result
+func (net *netT) receiveEncryptedMessageBytes(connection *goNet.Conn, messageSize uint32, error *bool) ([]byte, bool) { // nillable first result, second is false if the client has sent an invalid size
     utils.Assert(error != nil)
 
     var size uint32 = 0
-    if !net.receive(connection, unsafe.Slice((*byte) (unsafe.Pointer(&size)), intSize), error) { return nil }
-    utils.Assert(!*error && size > 0 && size <= uint32(crypto.EncryptedSize(maxMessageSize)))
+    if !net.receive(connection, unsafe.Slice((*byte) (unsafe.Pointer(&size)), intSize), error) { return nil, true }
+    if size <= uint32(crypto.EncryptedSize(0)) || size > uint32(crypto.EncryptedSize(uint(messageSize))) { return nil, false }
 
     net.setConnectionTimeoutBetweenMessageParts(connection)
 
     buffer := make([]byte, size)
-    if !net.receive(connection, buffer, error) { return nil }
+    if !net.receive(connection, buffer, error) { return nil, true }
 
-    return buffer
+    return buffer, true
 }
 
 func (net *netT) processEncryptedClientMessage(connectionId uint32, messageBytes []byte) int32 {
     coders := connections.getCoders(connectionId)
-    utils.Assert(coders != nil && len(messageBytes) > 0 && uint(len(messageBytes)) <= crypto.EncryptedSize(maxMessageSize))
+    if coders == nil { return flagFinish } // the connection has already been finished
+
+    messageSize := connections.getMessageSize(connectionId)
+    utils.Assert(len(messageBytes) > 0 && uint(len(messageBytes)) <= crypto.EncryptedSize(uint(messageSize)))
 
     decrypted := coders.Decrypt(messageBytes)
-    utils.Assert(len(decrypted) > 0 && len(decrypted) <= int(maxMessageSize)) // TODO: return flag_finish_with_error
-    message := net.unpackMessage(decrypted)
+    if len(decrypted) == 0 || len(decrypted) > int(messageSize) { return sync.finishWithError(connectionId, reasonDecryptionFailed) }
+
+    message := net.unpackMessage(decrypted, messageSize - uint32(messageHeadSize))
+    if message == nil { return sync.finishWithError(connectionId, reasonMalformedMessage) }
 
     return sync.routeMessage(connectionId, message)
 }
 
-//goland:noinspection GoRedundantConversion
-func (net *netT) sendMessage(connectionId uint32, msg *message) {
-    utils.Assert(int(msg.size) == len(msg.body) && msg.size <= uint32(maxMessageBodySize))
+func (_ *netT) sendMessage(connectionId uint32, msg *message) { // doesn't block, the message is sent by the receiver's writer
+    utils.Assert(msg != nil && int(msg.size) == len(msg.body))
 
-    coders := connections.getCoders(connectionId)
-    utils.Assert(msg != nil && coders != nil) // TODO: instead of asserting just return
+    xConnectedUser := connections.getConnectedUser(connectionId)
+    if xConnectedUser == nil { return } // the receiver has disconnected already
+
+    if !xConnectedUser.outbound.push(msg, connections.getUserMessageSize(xConnectedUser)) {
+        _ = (*(xConnectedUser.connection)).Close() // the receiver doesn't keep up, its reader will fail and finish the connection
+    }
+}
+
+func (_ *netT) sendMessageWaiting(connectionId uint32, msg *message) { // blocks while the receiver's outbound is full; for bulk replies sent by the receiver's own reader without any locks held, so a slow client gets throttled instead of disconnected
+    utils.Assert(msg != nil && int(msg.size) == len(msg.body))
+
+    xConnectedUser := connections.getConnectedUser(connectionId)
+    if xConnectedUser == nil { return }
+
+    xConnectedUser.outbound.pushWaiting(msg, connections.getUserMessageSize(xConnectedUser))
+}
+
+func (net *netT) writeMessages(connectionId uint32, xConnectedUser *connectedUser, done chan struct{}) { // the connection's writer, the only user of its encoder
+    defer func() { // as with the reader, a failure while serving one client mustn't take down the others
+        if recovered := recover(); recovered != nil {
+            logging.Error("connection's writer crashed", logging.ConnectionId(connectionId), logging.F("panic", fmt.Sprint(recovered)))
+            xConnectedUser.outbound.close()
+            _ = (*(xConnectedUser.connection)).Close() // the reader will fail and finish the connection
+            close(done)
+        }
+    }()
+
+    for outgoing := xConnectedUser.outbound.pop(); outgoing != nil; outgoing = xConnectedUser.outbound.pop() {
+        net.writeMessage(xConnectedUser, outgoing.msg, outgoing.messageSize)
+    }
+
+    connection := xConnectedUser.connection
+    if tcpConnection, ok := (*connection).(*goNet.TCPConn); ok { _ = tcpConnection.CloseWrite() } else { _ = (*connection).Close() }
+    _ = (*connection).SetReadDeadline(time.UnixMilli(int64(utils.CurrentTimeMillis()) + int64(timeout))) // nothing else is to be sent, the reader will fail and finish the connection if it hasn't done it yet, e.g. after a kick
+    close(done)
+}
+
+func (net *netT) writeMessage(xConnectedUser *connectedUser, msg *message, messageSize uint32) { // splits the message if it doesn't fit into the receiver's message size, then parts carry their own index & count
+    maxBodySize := messageSize - uint32(messageHeadSize)
+    if msg.size <= maxBodySize {
+        net.writeMessagePart(xConnectedUser, msg, messageSize)
+        return
+    }
 
-    connection := connections.getConnection(connectionId)
-    utils.Assert(connection != nil)
+    count := (msg.size + maxBodySize - 1) / maxBodySize
+    for index := uint32(0); index < count; index++ {
+        end := (index + 1) * maxBodySize
+        if end > msg.size { end = msg.size }
 
+        part := *msg
+        part.index = index
+        part.count = count
+        part.body = msg.body[index * maxBodySize:end]
+        part.size = uint32(len(part.body))
+
+        net.writeMessagePart(xConnectedUser, &part, messageSize)
+    }
+}
+
+//goland:noinspection GoRedundantConversion
+func (net *netT) writeMessagePart(xConnectedUser *connectedUser, msg *message, messageSize uint32) {
     packed := net.packMessage(msg)
-    encrypted := coders.Encrypt(packed)
-    utils.Assert(len(encrypted) > 0 && uint(len(encrypted)) <= crypto.EncryptedSize(maxMessageSize) && int(crypto.EncryptedSize(uint(len(packed)))) == len(encrypted))
+    encrypted := xConnectedUser.coders.Encrypt(packed)
+    if encrypted == nil { return }
+    utils.Assert(uint(len(encrypted)) <= crypto.EncryptedSize(uint(messageSize)) && int(crypto.EncryptedSize(uint(len(packed)))) == len(encrypted))
 
     encryptedSize := uint32(len(encrypted))
 
@@ -364,5 +502,5 @@ func (net *netT) sendMessage(connectionId uint32, msg *message) {
     copy(buffer, unsafe.Slice((*byte) (unsafe.Pointer(&encryptedSize)), intSize))
     copy(unsafe.Slice(&(buffer[intSize]), encryptedSize), encrypted)
 
-    net.send(connection, buffer)
+    net.send(xConnectedUser.connection, buffer)
 }
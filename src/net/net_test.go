@@ -19,7 +19,11 @@
 package net
 
 import (
+    "ExchatgeServer/crypto"
+    "ExchatgeServer/database"
     "bytes"
+    "io"
+    goNet "net"
     "testing"
     "unsafe"
 )
@@ -83,7 +87,7 @@ func TestUnpackMessage(t *testing.T) {
         packed = []byte{0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 3, 0, 0, 0, 4, 0, 0, 0, 5, 0, 0, 0, 6, 0, 0, 0, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7}
     }
 
-    unpacked := ((*netT) (nil)).unpackMessage(packed)
+    unpacked := ((*netT) (nil)).unpackMessage(packed, 160)
 
     if unpacked.flag != 0 { t.Error() }
     if unpacked.timestamp != 1 { t.Error() }
@@ -124,3 +128,298 @@ func TestPackUserInfo(t *testing.T) {
     if packed[4] != 1 { t.Error() }
     if !bytes.Equal(packed[5:], name[:]) { t.Error() }
 }
+
+func TestUnpackDirectoryQuery(t *testing.T) {
+    body := []byte{2, 0, 0, 0, 5, 0, 0, 0, 1, 'u', 's', 'e', 'r', 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+
+    query := ((*netT) (nil)).unpackDirectoryQuery(body)
+    if query == nil || query.fromId != 2 || query.pageSize != 5 || !query.onlineOnly || !bytes.Equal(query.prefix[:], body[9:]) { t.Error() }
+
+    if ((*netT) (nil)).unpackDirectoryQuery(body[:24]) != nil { t.Error() }
+    body[8] = 2
+    if ((*netT) (nil)).unpackDirectoryQuery(body) != nil { t.Error() }
+}
+
+func TestPackPresenceInfo(t *testing.T) {
+    packed := ((*netT) (nil)).packPresenceInfo(&presenceInfo{2, false, 0x0102})
+
+    if len(packed) != 13 || packed[0] != 2 || packed[4] != 0 { t.Error() }
+    if packed[5] != 2 || packed[6] != 1 { t.Error() }
+    for _, i := range packed[7:] { if i != 0 { t.Error() } }
+}
+
+func TestPackMessageIds(t *testing.T) {
+    packed := ((*netT) (nil)).packMessageIds([]database.Message{{Id: 0x0102, Timestamp: 3, From: 1, To: 2}, {Id: 0, Timestamp: 4, From: 1, To: 2}, {Id: 5, Timestamp: 6, From: 1, To: 2, Room: 7}})
+
+    if len(packed) != 48 || packed[0] != 1 || packed[4] != 2 || packed[8] != 3 { t.Error() } // the one without id is skipped
+    if packed[16] != 2 || packed[17] != 1 { t.Error() }
+    if packed[28] != 7 || packed[40] != 5 { t.Error() } // the room instead of the member
+}
+
+func TestPackMessageStatus(t *testing.T) {
+    packed := ((*netT) (nil)).packMessageStatus(0x0102, database.MessageRead)
+
+    if len(packed) != 9 || packed[0] != 2 || packed[1] != 1 || packed[8] != database.MessageRead { t.Error() }
+}
+
+//goland:noinspection GoRedundantConversion
+func TestQueueAcknowledgement(t *testing.T) {
+    crypto.Initialize(make([]byte, crypto.SecretKeySize))
+    database.Initialize(database.InitMemoryStorage(10), []byte{'a', 'd', 'm', 'i', 'n', 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0})
+    syncInitialize(10)
+
+    Net = &netT{maxMultipartMessageSize: 1024}
+    connections.addNewConnection(0, nil, nil, makeOutbound())
+
+    msg := &message{flag: flagProceed, timestamp: 1, size: 1, index: 0, count: 1, from: 1, to: 2, body: []byte{8}}
+    if sync.proceedRequested(0, msg) != flagProceed { t.Error() } // user 2 is offline
+    msg = &message{flag: flagProceed, timestamp: 1, size: 1, index: 0, count: 1, from: 1, to: 2, body: []byte{9}}
+    if sync.proceedRequested(0, msg) != flagProceed { t.Error() } // within the same millisecond
+
+    queued, _ := database.GetQueuedMessages(2)
+    if len(queued) != 2 || queued[0].From != 1 || queued[0].Timestamp != 1 || queued[0].Id == 0 || queued[1].Id == queued[0].Id { t.Error() }
+
+    second := queued[1].Id
+    body := append([]byte(nil), unsafe.Slice((*byte) (unsafe.Pointer(&second)), 8)...)
+
+    ack := &message{flag: flagAcknowledge, timestamp: 2, size: uint32(len(body)), index: 0, count: 1, from: 2, to: toServer, body: body}
+    if sync.acknowledgementRequested(0, ack) != flagProceed { t.Error() }
+    if queued, _ = database.GetQueuedMessages(2); len(queued) != 1 || queued[0].Id == second || queued[0].Body[0] != 8 { t.Error() } // only the acknowledged one is removed
+    if sync.acknowledgementRequested(0, ack) != flagProceed { t.Error() } // already removed
+    if queued, _ = database.GetQueuedMessages(2); len(queued) != 1 { t.Error() }
+
+    ack = &message{flag: flagAcknowledge, timestamp: 2, size: 3, index: 0, count: 1, from: 2, to: toServer, body: []byte{1, 0, 0}}
+    if sync.acknowledgementRequested(0, ack) != flagError { t.Error() }
+
+    connections.deleteConnection(0)
+    Net = nil
+    sync = nil
+    database.Destroy()
+}
+
+func TestRoomMessage(t *testing.T) {
+    crypto.Initialize(make([]byte, crypto.SecretKeySize))
+    database.Initialize(database.InitMemoryStorage(10), []byte{'a', 'd', 'm', 'i', 'n', 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0})
+    syncInitialize(10)
+
+    Net = &netT{maxMultipartMessageSize: 1024, reassembleMessages: true}
+    connections.addNewConnection(0, nil, nil, makeOutbound())
+
+    room, _ := database.CreateRoom([]byte{'r', 'o', 'o', 'm'}, 1)
+    _, _ = database.AddRoomMember(room.Id, 2)
+    _, _ = database.AddRoomMember(room.Id, 3)
+
+    msg := &message{flag: flagProceed, timestamp: 1, size: 1, index: 0, count: 2, from: 1, to: 2, body: []byte{7}}
+    if sync.proceedRequested(0, msg) != flagProceed { t.Error() } // a direct multipart message to the user whose id is the same as the room's
+
+    msg = &message{flag: flagRoomMessage, timestamp: 1, size: 1, index: 0, count: 2, from: 1, to: room.Id, body: []byte{8}}
+    if sync.roomMessageRequested(0, msg) != flagProceed { t.Error() } // doesn't interleave with the direct one
+    if queued, _ := database.GetQueuedMessages(3); len(queued) != 0 { t.Error() } // stored when the last part arrives
+
+    msg = &message{flag: flagRoomMessage, timestamp: 1, size: 1, index: 1, count: 2, from: 1, to: room.Id, body: []byte{9}}
+    if sync.roomMessageRequested(0, msg) != flagProceed { t.Error() }
+
+    stored, _ := database.GetRoomMessages(room.Id, database.MessageCursor{}, database.MessageCursor{Timestamp: 100}, 10, true)
+    if len(stored) != 1 || stored[0].Id == 0 || !bytes.Equal(stored[0].Body, []byte{8, 9}) { t.Fatal() } // once, as a whole
+
+    for _, member := range []uint32{2, 3} {
+        queued, _ := database.GetQueuedMessages(member)
+        if len(queued) != 1 || queued[0].Id != stored[0].Id || queued[0].Room != room.Id || !bytes.Equal(queued[0].Body, []byte{8, 9}) { t.Error() }
+    }
+    if queued, _ := database.GetQueuedMessages(1); len(queued) != 0 { t.Error() } // not for the sender
+
+    connections.deleteConnection(0)
+    Net = nil
+    sync = nil
+    database.Destroy()
+}
+
+func TestLastSeen(t *testing.T) {
+    crypto.Initialize(make([]byte, crypto.SecretKeySize))
+    database.Initialize(database.InitMemoryStorage(10), []byte{'a', 'd', 'm', 'i', 'n', 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0})
+    syncInitialize(10)
+
+    Net = &netT{}
+    user, _ := database.AddUser([]byte{'u', 's', 'e', 'r'}, make([]byte, crypto.HashSize))
+
+    connections.addNewConnection(0, nil, nil, makeOutbound())
+    connections.setUser(0, user)
+
+    sync.rwMutex.Lock()
+    xDisconnection := connections.deleteConnection(0)
+    sync.rwMutex.Unlock()
+
+    if xDisconnection == nil || xDisconnection.userId != user.Id || xDisconnection.lastSeenMillis == 0 { t.Fatal() }
+    if found, _ := database.FindUserById(user.Id); found.LastSeenMillis != 0 { t.Error() } // not written under the lock
+
+    sync.storeLastSeen(xDisconnection)
+    if found, _ := database.FindUserById(user.Id); found.LastSeenMillis != xDisconnection.lastSeenMillis { t.Error() }
+
+    if connections.deleteConnection(0) != nil { t.Error() }
+    sync.storeLastSeen(nil)
+
+    Net = nil
+    sync = nil
+    database.Destroy()
+}
+
+func TestOutbound(t *testing.T) {
+    outbound := makeOutbound()
+    for i := 0; i < outboundSize; i++ { outbound.pushWaiting(&message{index: uint32(i)}, uint32(maxMessageSize)) }
+    if outbound.push(&message{}, uint32(maxMessageSize)) { t.Error() } // full
+
+    waited := make(chan struct{})
+    go func() {
+        outbound.pushWaiting(&message{index: outboundSize}, uint32(maxMessageSize)) // waits for the writer instead of failing
+        close(waited)
+    }()
+
+    if outgoing := outbound.pop(); outgoing == nil || outgoing.msg.index != 0 || outgoing.messageSize != uint32(maxMessageSize) { t.Error() }
+    <-waited
+
+    outbound.close()
+    outbound.pushWaiting(&message{}, uint32(maxMessageSize)) // dropped without blocking
+
+    count := 0
+    for outgoing := outbound.pop(); outgoing != nil; outgoing = outbound.pop() { count++ } // what's left is still sent
+    if count != outboundSize { t.Error() }
+}
+
+func TestStoredTombstone(t *testing.T) {
+    crypto.Initialize(make([]byte, crypto.SecretKeySize))
+    syncInitialize(10)
+
+    tombstone := &database.Message{Timestamp: 1, From: 1, To: 2, Body: []byte{}, Deleted: true} // as the mongo driver decodes it
+    msg := sync.storedMessage(flagFetchMessages, tombstone, 0, 1, 2)
+    if msg.size != 0 || msg.body != nil || msg.from != 1 || msg.timestamp != 1 { t.Error() }
+    if packed := ((*netT) (nil)).packMessage(msg); len(packed) != int(messageHeadSize) { t.Error() }
+
+    msg = sync.storedMessage(flagFetchMessages, &database.Message{Timestamp: 1, From: 1, To: 2, Body: []byte{3}}, 0, 1, 2)
+    if msg.size != 1 || !bytes.Equal(msg.body, []byte{3}) { t.Error() }
+
+    sync = nil
+}
+
+func TestWriterCrash(t *testing.T) {
+    client, server := goNet.Pipe()
+    xConnectedUser := &connectedUser{connection: &server, outbound: makeOutbound()}
+
+    xConnectedUser.outbound.push(&message{flag: flagProceed, size: 0, body: []byte{}}, uint32(maxMessageSize)) // fails the packing
+    done := make(chan struct{})
+    ((*netT) (nil)).writeMessages(0, xConnectedUser, done)
+
+    <-done
+    if _, err := client.Read(make([]byte, 1)); err == nil { t.Error() } // only this connection is closed
+}
+
+//goland:noinspection GoRedundantConversion
+func TestMessageSizeGrant(t *testing.T) {
+    crypto.Initialize(make([]byte, crypto.SecretKeySize))
+    syncInitialize(10)
+
+    Net = &netT{maxNegotiableMessageSize: 1024, maxTimeMillisIntervalBetweenMessages: 1000}
+    client, server := goNet.Pipe()
+    key := crypto.GenerateKey()
+    header, coders := crypto.CreateEncoderStream(key)
+    coders.CreateDecoderStream(key, header) // the encoder needs both
+    xConnectedUser := connections.addNewConnection(0, &server, coders, makeOutbound())
+
+    large := func() *message { return &message{flag: flagProceed, timestamp: 1, size: 500, index: 0, count: 1, from: 1, to: 2, body: make([]byte, 500)} }
+
+    Net.sendMessage(0, large()) // queued before the grant
+    var size uint32 = 1024
+    grant := &message{flag: flagMessageSize, timestamp: 1, size: intSize, index: 0, count: 1, from: 2, to: toServer, body: unsafe.Slice((*byte) (unsafe.Pointer(&size)), intSize)}
+    if sync.messageSizeRequested(0, grant) != flagProceed { t.Error() }
+    Net.sendMessage(0, large()) // queued after the grant
+
+    done := make(chan struct{})
+    go Net.writeMessages(0, xConnectedUser, done) // starts only after the grant, as a slow writer would
+    xConnectedUser.outbound.close()
+
+    var frames []uint32
+    for {
+        var frameSize uint32
+        if _, err := io.ReadFull(client, unsafe.Slice((*byte) (unsafe.Pointer(&frameSize)), intSize)); err != nil { break }
+        if _, err := io.ReadFull(client, make([]byte, frameSize)); err != nil { t.Error() }
+        frames = append(frames, frameSize)
+    }
+    <-done
+
+    if len(frames) != 6 { t.Fatal(len(frames)) } // the first message is split into 4 parts, then the reply & the second message
+    for _, frameSize := range frames[:5] { if frameSize > uint32(crypto.EncryptedSize(maxMessageSize)) { t.Error() } } // what the client reads with the previous size
+    if frames[4] != uint32(crypto.EncryptedSize(uint(messageHeadSize) + intSize)) { t.Error() }
+    if frames[5] != uint32(crypto.EncryptedSize(uint(messageHeadSize) + 500)) { t.Error() }
+
+    connections.deleteConnection(0)
+    Net = nil
+    sync = nil
+}
+
+func TestUnpackMalformedMessage(t *testing.T) {
+    if ((*netT) (nil)).unpackMessage(make([]byte, 95), 160) != nil { t.Error() } // shorter than the head
+
+    packed := make([]byte, 96 + 2)
+    packed[4 + 8] = 3 // size is greater than the actual body
+    if ((*netT) (nil)).unpackMessage(packed, 160) != nil { t.Error() }
+
+    packed[4 + 8] = 0xff; packed[4 + 8 + 1] = 0xff // size exceeds the maximum body size
+    if ((*netT) (nil)).unpackMessage(packed, 160) != nil { t.Error() }
+}
+
+func TestSequences(t *testing.T) {
+    sequences := makeSequences()
+    part := func(to uint32, index uint32, count uint32, size uint32) *message {
+        return &message{flag: flagProceed, timestamp: 1, size: size, index: index, count: count, from: 1, to: to, body: make([]byte, size)}
+    }
+
+    if state, completed := sequences.accept(part(2, 0, 1, 10), 100, true); state != sequenceCompleted || completed.totalSize != 10 { t.Error() }
+
+    if state, _ := sequences.accept(part(2, 0, 3, 10), 100, true); state != sequencePartAccepted { t.Error() }
+    if state, _ := sequences.accept(part(3, 0, 2, 10), 100, true); state != sequencePartAccepted { t.Error() } // other recipient
+    if state, _ := sequences.accept(part(2, 1, 3, 10), 100, true); state != sequencePartAccepted { t.Error() }
+
+    state, completed := sequences.accept(part(2, 2, 3, 10), 100, true)
+    if state != sequenceCompleted || completed.totalSize != 30 || len(completed.body) != 30 { t.Error() }
+
+    if state, _ := sequences.accept(part(3, 0, 2, 10), 100, true); state != sequenceViolated { t.Error() } // previous one isn't finished
+    if state, _ := sequences.accept(part(4, 1, 2, 10), 100, true); state != sequenceViolated { t.Error() } // no beginning
+    if state, _ := sequences.accept(part(4, 0, 0, 10), 100, true); state != sequenceViolated { t.Error() } // invalid count
+
+    if state, _ := sequences.accept(part(5, 0, 3, 10), 100, true); state != sequencePartAccepted { t.Error() }
+    if state, _ := sequences.accept(part(5, 2, 3, 10), 100, true); state != sequenceViolated { t.Error() } // gap
+
+    if state, _ := sequences.accept(part(6, 0, 3, 10), 100, true); state != sequencePartAccepted { t.Error() }
+    if state, _ := sequences.accept(part(6, 1, 4, 10), 100, true); state != sequenceViolated { t.Error() } // inconsistent count
+
+    if state, _ := sequences.accept(part(7, 0, 3, 60), 100, false); state != sequencePartAccepted { t.Error() }
+    if state, _ := sequences.accept(part(7, 1, 3, 60), 100, false); state != sequenceViolated { t.Error() } // too large
+
+    if state, _ := sequences.accept(part(8, 0, 2, 10), 100, false); state != sequencePartAccepted { t.Error() }
+    sequences.entries[8].startedMillis -= sequenceTimeout + 1
+    if state, _ := sequences.accept(part(8, 1, 2, 10), 100, false); state != sequenceViolated { t.Error() } // expired
+}
+
+func TestRateLimits(t *testing.T) {
+    rateLimits := makeRateLimits([rateClassesCount]RateLimit{{1, 2}, {1, 1}, {1, 1}})
+    userId := uint32(1)
+
+    if rateLimits.take(flagProceed, 0, &userId, "127.0.0.1") != 0 { t.Error() }
+    if rateLimits.take(flagProceed, 0, &userId, "127.0.0.1") != 0 { t.Error() }
+    if wait := rateLimits.take(flagProceed, 0, &userId, "127.0.0.1"); wait == 0 || wait > 1001 { t.Error() } // the burst is exhausted
+
+    if rateLimits.take(flagFetchUsers, 0, &userId, "127.0.0.1") != 0 { t.Error() } // other class
+    if rateLimits.take(flagProceed, 1, nil, "127.0.0.1") != 0 { t.Error() } // other connection, the address' bucket is larger
+
+    if !isRateLimited(&message{flag: flagProceed, index: 0, count: 3}) || isRateLimited(&message{flag: flagProceed, index: 1, count: 3}) { t.Error() } // once per multipart message
+    if isRateLimited(&message{flag: flagRoomMessage, index: 1, count: 3}) { t.Error() }
+    if !isRateLimited(&message{flag: flagFetchUsers, index: 1, count: 3}) { t.Error() } // only sequences are validated
+
+    for i := 0; i < 3; i++ { _ = rateLimits.take(flagLogIn, uint32(2 + i), nil, "127.0.0.2") }
+    if rateLimits.take(flagLogIn, 5, nil, "127.0.0.2") != 0 { t.Error() } // 4 tokens of the address' bucket
+    if rateLimits.take(flagLogIn, 6, nil, "127.0.0.2") == 0 { t.Error() } // that's it
+
+    rateLimits.buckets["0:c0"].lastMillis -= 1000 // a second has passed
+    rateLimits.buckets["0:u1"].lastMillis -= 1000
+    rateLimits.buckets["0:a127.0.0.1"].lastMillis -= 1000
+    if rateLimits.take(flagProceed, 0, &userId, "127.0.0.1") != 0 { t.Error() }
+}
@@ -0,0 +1,145 @@
+/*
+ * Exchatge - a secured realtime message exchanger (server).
+ * Copyright (C) 2023-2024  Vadim Nikolaev (https://github.com/vadniks)
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+
+package net
+
+import (
+    "ExchatgeServer/database"
+    "ExchatgeServer/utils"
+    "unsafe"
+)
+
+const (
+    flagSubscribeToPresence int32 = 0x00000023 // body: ids of the contacts to watch or nothing to watch everyone, replaces the previous subscription; replies with presenceInfos of the contacts
+    flagUnsubscribeFromPresence int32 = 0x00000024
+    flagPresence int32 = 0x00000025 // pushed to the subscribers when a user logs in or disconnects; body: presenceInfo
+
+    presenceInfoSize = intSize + 1/*sizeof(bool)*/ + longSize // 13
+    maxPresenceContacts = 256
+)
+
+type disconnection struct { // the user's last seen time, stored outside of the sync's exclusive lock as it's a blocking database write
+    userId uint32
+    lastSeenMillis uint64
+}
+
+type presenceInfo struct {
+    id uint32
+    online bool
+    lastSeenMillis uint64 // 0 while online or if the user has never been seen
+}
+
+//goland:noinspection GoRedundantConversion
+func (_ *netT) packPresenceInfo(xPresenceInfo *presenceInfo) []byte {
+    utils.Assert(unsafe.Sizeof(false) == 1)
+    bytes := make([]byte, presenceInfoSize)
+
+    copy(unsafe.Slice(&(bytes[0]), intSize), unsafe.Slice((*byte) (unsafe.Pointer(&(xPresenceInfo.id))), intSize))
+    copy(unsafe.Slice(&(bytes[intSize]), 1), unsafe.Slice((*byte) (unsafe.Pointer(&(xPresenceInfo.online))), 1))
+    copy(unsafe.Slice(&(bytes[intSize + 1]), longSize), unsafe.Slice((*byte) (unsafe.Pointer(&(xPresenceInfo.lastSeenMillis))), longSize))
+
+    return bytes
+}
+
+func (connections *connectionsT) setPresenceContacts(connectionId uint32, contacts map[uint32]bool /*nillable*/) {
+    xConnectedUser := connections.getConnectedUser(connectionId)
+    if xConnectedUser == nil { return }
+
+    connections.rwMutex.Lock()
+    xConnectedUser.presenceContacts = contacts
+    connections.rwMutex.Unlock()
+}
+
+func (connections *connectionsT) publishPresence(userId uint32, online bool, lastSeenMillis uint64) { // to everyone who watches either everyone or this user, except the user itself
+    var subscribers []uint32 = nil
+    var subscriberIds []uint32 = nil
+
+    connections.doForEachConnectedAuthorizedUser(func(connectionId uint32, xConnectedUser *connectedUser) {
+        contacts := xConnectedUser.presenceContacts
+        if contacts == nil || xConnectedUser.user.Id == userId { return }
+        if len(contacts) > 0 && !contacts[userId] { return }
+
+        subscribers = append(subscribers, connectionId)
+        subscriberIds = append(subscriberIds, xConnectedUser.user.Id)
+    })
+
+    if len(subscribers) == 0 { return }
+    body := Net.packPresenceInfo(&presenceInfo{userId, online, lastSeenMillis})
+
+    for i, connectionId := range subscribers { Net.sendMessage(connectionId, sync.serverMessage(flagPresence, subscriberIds[i], body)) }
+}
+
+func (connections *connectionsT) userDisconnected(userId uint32) *disconnection {
+    lastSeenMillis := utils.CurrentTimeMillis()
+    connections.publishPresence(userId, false, lastSeenMillis)
+    return &disconnection{userId, lastSeenMillis}
+}
+
+func (sync *syncT) storeLastSeen(xDisconnection *disconnection /*nillable*/) {
+    if xDisconnection == nil || sync.degraded() { return }
+    _ = database.SetLastSeen(xDisconnection.userId, xDisconnection.lastSeenMillis) // failures are logged by the database
+}
+
+//goland:noinspection GoRedundantConversion
+func (sync *syncT) presenceSubscriptionRequested(connectionId uint32, msg *message) int32 {
+    if msg.size % uint32(intSize) != 0 || msg.size > maxPresenceContacts * uint32(intSize) { return sync.finishWithError(connectionId, reasonMalformedMessage) }
+
+    contacts := make(map[uint32]bool)
+    var orderedContacts []uint32 = nil // as in the request
+
+    for i := uint32(0); i < msg.size; i += uint32(intSize) {
+        var contact uint32
+        copy(unsafe.Slice((*byte) (unsafe.Pointer(&contact)), intSize), msg.body[i:])
+
+        if !contacts[contact] { orderedContacts = append(orderedContacts, contact) }
+        contacts[contact] = true
+    }
+
+    connections.setPresenceContacts(connectionId, contacts)
+
+    var presenceInfosBytes []byte
+    for _, contact := range orderedContacts {
+        xPresenceInfo := &presenceInfo{contact, true, 0}
+
+        if _, user := connections.getAuthorizedConnectedUser(contact); user == nil {
+            sync.rwMutex.RLock()
+            user, err := database.FindUserById(contact)
+            sync.rwMutex.RUnlock()
+
+            if err != nil { return sync.finishWithError(connectionId, reasonDatabaseFailure) }
+            if user == nil { continue }
+
+            xPresenceInfo.online = false
+            xPresenceInfo.lastSeenMillis = user.LastSeenMillis
+        }
+
+        presenceInfosBytes = append(presenceInfosBytes, Net.packPresenceInfo(xPresenceInfo)...)
+    }
+
+    sync.sendRecords(connectionId, flagSubscribeToPresence, msg.from, presenceInfosBytes, presenceInfoSize)
+    return flagProceed
+}
+
+func (sync *syncT) presenceUnsubscriptionRequested(connectionId uint32, msg *message) int32 {
+    if msg.size != 0 { return sync.finishWithError(connectionId, reasonMalformedMessage) }
+
+    connections.setPresenceContacts(connectionId, nil)
+    Net.sendMessage(connectionId, sync.simpleServerMessage(flagUnsubscribeFromPresence, msg.from))
+    return flagProceed
+}
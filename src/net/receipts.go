@@ -0,0 +1,87 @@
+/*
+ * Exchatge - a secured realtime message exchanger (server).
+ * Copyright (C) 2023-2024  Vadim Nikolaev (https://github.com/vadniks)
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+
+package net
+
+import (
+    "ExchatgeServer/database"
+    "unsafe"
+)
+
+const (
+    flagRead int32 = 0x00000029 // body consists of the ids (see flagMessageIds) of the messages the user has read
+    flagMessageStatus int32 = 0x0000002a // pushed to the sender when its message gets delivered or read; body: the message's id, status (one of database.Message*)
+
+    messageStatusSize = longSize + 1 // 9
+)
+
+//goland:noinspection GoRedundantConversion
+func (_ *netT) packMessageStatus(id uint64, status uint8) []byte {
+    bytes := make([]byte, messageStatusSize)
+
+    copy(unsafe.Slice(&(bytes[0]), longSize), unsafe.Slice((*byte) (unsafe.Pointer(&id)), longSize))
+    bytes[longSize] = status
+
+    return bytes
+}
+
+func (sync *syncT) changeMessageStatus(to uint32, id uint64, status uint8) error { // must be called with the mutex locked; notifies the sender if it's online & the status has changed
+    changed, err := database.SetMessageStatus(to, id, status)
+    if changed == nil || err != nil { return err }
+
+    if senderConnectionId, sender := connections.getAuthorizedConnectedUser(changed.From); sender != nil {
+        Net.sendMessage(senderConnectionId, sync.serverMessage(flagMessageStatus, changed.From, Net.packMessageStatus(id, status)))
+    }
+    return nil
+}
+
+func (sync *syncT) messagesDelivered(connectionId uint32, recipient uint32, messages []database.Message) int32 { // called after the messages have been handed to the recipient, e.g. via the queue or the history
+    sync.rwMutex.Lock()
+
+    for i := range messages {
+        xMessage := &(messages[i])
+        if xMessage.To != recipient || xMessage.Id == 0 || xMessage.Room > 0 || xMessage.Deleted || xMessage.Status >= database.MessageDelivered { continue }
+
+        if err := sync.changeMessageStatus(recipient, xMessage.Id, database.MessageDelivered); err != nil {
+            sync.rwMutex.Unlock()
+            return sync.finishWithError(connectionId, reasonDatabaseFailure)
+        }
+    }
+
+    sync.rwMutex.Unlock()
+    return flagProceed
+}
+
+func (sync *syncT) readRequested(connectionId uint32, msg *message) int32 {
+    if msg.size == 0 || msg.size % longSize != 0 || msg.body == nil {
+        Net.sendMessage(connectionId, sync.errorMessage(flagRead, msg.from))
+        return flagError
+    }
+
+    sync.rwMutex.Lock()
+    for offset := uint32(0); offset < msg.size; offset += longSize {
+        if err := sync.changeMessageStatus(msg.from, Net.unpackId(msg.body[offset:]), database.MessageRead); err != nil {
+            sync.rwMutex.Unlock()
+            return sync.finishWithError(connectionId, reasonDatabaseFailure)
+        }
+    }
+    sync.rwMutex.Unlock()
+
+    return flagProceed
+}
@@ -0,0 +1,68 @@
+/*
+ * Exchatge - a secured realtime message exchanger (server).
+ * Copyright (C) 2023-2024  Vadim Nikolaev (https://github.com/vadniks)
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+
+package net
+
+import (
+    "ExchatgeServer/crypto"
+    "ExchatgeServer/database"
+    "ExchatgeServer/utils"
+)
+
+const (
+    flagResume int32 = 0x0000001d // body: resume token, obtained along with flagLoggedIn; sent instead of flagLogIn by a freshly connected client
+    flagRevokeResumeTokens int32 = 0x0000001e // invalidates all the user's resume tokens issued so far, e.g. if one has leaked
+)
+
+func (sync *syncT) resumeRequested(connectionId uint32, msg *message) int32 { // re-authenticates the user without the password
+    if msg.body == nil || uint(msg.size) != crypto.TokenSize { return sync.finishWithError(connectionId, reasonMalformedMessage) }
+
+    var resumeToken [crypto.TokenSize]byte
+    copy(resumeToken[:], msg.body)
+
+    var user *database.User = nil
+    var err error = nil
+
+    userId, issuedMillis := crypto.OpenResumeToken(resumeToken)
+    now := utils.CurrentTimeMillis()
+
+    if userId != nil && issuedMillis != nil && *issuedMillis <= now && now - *issuedMillis <= Net.maxTimeMillisToPreserveResumeToken {
+        sync.rwMutex.RLock()
+        user, err = database.FindUserById(*userId)
+        sync.rwMutex.RUnlock()
+    }
+
+    if err != nil { return sync.finishWithError(connectionId, reasonDatabaseFailure) }
+    if user != nil && *issuedMillis <= user.TokensRevokedMillis { user = nil }
+
+    return sync.logIn(connectionId, user, flagResume)
+}
+
+func (sync *syncT) resumeTokensRevocationRequested(connectionId uint32, msg *message) int32 {
+    if msg.size != 0 { return sync.finishWithError(connectionId, reasonMalformedMessage) }
+
+    sync.rwMutex.Lock()
+    err := database.RevokeResumeTokens(msg.from)
+    sync.rwMutex.Unlock()
+
+    if err != nil { return sync.finishWithError(connectionId, reasonDatabaseFailure) }
+
+    Net.sendMessage(connectionId, sync.simpleServerMessage(flagRevokeResumeTokens, msg.from))
+    return flagProceed
+}
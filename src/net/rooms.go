@@ -0,0 +1,300 @@
+/*
+ * Exchatge - a secured realtime message exchanger (server).
+ * Copyright (C) 2023-2024  Vadim Nikolaev (https://github.com/vadniks)
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+
+package net
+
+import (
+    "ExchatgeServer/database"
+    "ExchatgeServer/utils"
+    "math"
+    "unsafe"
+)
+
+const (
+    flagCreateRoom int32 = 0x00000010 // body: name; reply body: roomInfo
+    flagInviteToRoom int32 = 0x00000011 // body: room id, user id; any member can invite, the invitee gets roomInfo if online
+    flagRemoveFromRoom int32 = 0x00000012 // body: room id, user id; only the owner can remove, the removed user gets the same body if online
+    flagLeaveRoom int32 = 0x00000013 // body: room id
+    flagFetchRooms int32 = 0x00000014 // replies with roomInfos of the rooms the user is a member of
+    flagRoomMessage int32 = 0x00000015 // 'to' is the room id; multipart ones follow the same rules as flagProceed
+
+    roomInfoSize = intSize * 2 + usernameSize // 24
+)
+
+type roomInfo struct {
+    id uint32
+    owner uint32
+    name [usernameSize]byte
+}
+
+//goland:noinspection GoRedundantConversion
+func (_ *netT) packRoomInfo(xRoomInfo *roomInfo) []byte {
+    bytes := make([]byte, roomInfoSize)
+
+    copy(unsafe.Slice(&(bytes[0]), intSize), unsafe.Slice((*byte) (unsafe.Pointer(&(xRoomInfo.id))), intSize))
+    copy(unsafe.Slice(&(bytes[intSize]), intSize), unsafe.Slice((*byte) (unsafe.Pointer(&(xRoomInfo.owner))), intSize))
+    copy(unsafe.Slice(&(bytes[intSize * 2]), usernameSize), unsafe.Slice((*byte) (unsafe.Pointer(&(xRoomInfo.name))), usernameSize))
+
+    return bytes
+}
+
+func (_ *netT) makeRoomInfo(room *database.Room) *roomInfo {
+    xRoomInfo := &roomInfo{id: room.Id, owner: room.Owner, name: [usernameSize]byte{}}
+    copy(xRoomInfo.name[:], room.Name)
+    return xRoomInfo
+}
+
+func (sync *syncT) findRoomOfMember(connectionId uint32, roomId uint32, userId uint32) (*database.Room, int32) { // nillable first result, second is the flag to return if the room is nil
+    room, err := database.GetRoom(roomId)
+    if err != nil { return nil, sync.finishWithError(connectionId, reasonDatabaseFailure) }
+    if room == nil { return nil, flagError }
+
+    member, err := database.IsRoomMember(roomId, userId)
+    if err != nil { return nil, sync.finishWithError(connectionId, reasonDatabaseFailure) }
+    if !member { return nil, flagError }
+
+    return room, flagProceed
+}
+
+func (sync *syncT) roomCreationRequested(connectionId uint32, msg *message) int32 {
+    if msg.body == nil || uint(msg.size) != usernameSize { return sync.finishWithError(connectionId, reasonMalformedMessage) }
+
+    nonZeroes := uint(0)
+    for _, i := range msg.body { if i != 0 && i != byte(' ') { nonZeroes++ } }
+
+    if nonZeroes < minCredentialSize {
+        Net.sendMessage(connectionId, sync.errorMessage(flagCreateRoom, msg.from))
+        return flagError
+    }
+
+    sync.rwMutex.Lock()
+    room, err := database.CreateRoom(msg.body, msg.from)
+    sync.rwMutex.Unlock()
+
+    if err != nil { return sync.finishWithError(connectionId, reasonDatabaseFailure) }
+
+    if room == nil {
+        Net.sendMessage(connectionId, sync.errorMessage(flagCreateRoom, msg.from))
+        return flagError
+    }
+
+    Net.sendMessage(connectionId, sync.serverMessage(flagCreateRoom, msg.from, Net.packRoomInfo(Net.makeRoomInfo(room))))
+    return flagProceed
+}
+
+func (sync *syncT) roomInvitationRequested(connectionId uint32, msg *message) int32 {
+    roomId, userId, ok := sync.parseIntPair(msg)
+    if !ok { return sync.finishWithError(connectionId, reasonMalformedMessage) }
+
+    sync.rwMutex.Lock()
+    room, flag := sync.findRoomOfMember(connectionId, roomId, msg.from)
+
+    var added bool
+    var err error = nil
+    if room != nil {
+        var exists bool
+        if exists, err = database.UserExists(userId); exists && err == nil { added, err = database.AddRoomMember(roomId, userId) }
+    }
+    sync.rwMutex.Unlock()
+
+    if flag == flagFinishWithError { return flag }
+    if err != nil { return sync.finishWithError(connectionId, reasonDatabaseFailure) }
+
+    if !added {
+        Net.sendMessage(connectionId, sync.errorMessage(flagInviteToRoom, msg.from))
+        return flagError
+    }
+
+    if inviteeConnectionId, invitee := connections.getAuthorizedConnectedUser(userId); invitee != nil {
+        Net.sendMessage(inviteeConnectionId, sync.serverMessage(flagInviteToRoom, userId, Net.packRoomInfo(Net.makeRoomInfo(room))))
+    }
+
+    Net.sendMessage(connectionId, sync.serverMessage(flagInviteToRoom, msg.from, msg.body))
+    return flagProceed
+}
+
+func (sync *syncT) roomMemberRemovalRequested(connectionId uint32, msg *message) int32 {
+    roomId, userId, ok := sync.parseIntPair(msg)
+    if !ok { return sync.finishWithError(connectionId, reasonMalformedMessage) }
+
+    sync.rwMutex.Lock()
+    room, flag := sync.findRoomOfMember(connectionId, roomId, msg.from)
+
+    removed := false
+    var err error = nil
+    if room != nil && room.Owner == msg.from && userId != msg.from { removed, err = database.RemoveRoomMember(roomId, userId) } // the owner leaves instead
+    sync.rwMutex.Unlock()
+
+    if flag == flagFinishWithError { return flag }
+    if err != nil { return sync.finishWithError(connectionId, reasonDatabaseFailure) }
+
+    if !removed {
+        Net.sendMessage(connectionId, sync.errorMessage(flagRemoveFromRoom, msg.from))
+        return flagError
+    }
+
+    if removedConnectionId, removedUser := connections.getAuthorizedConnectedUser(userId); removedUser != nil {
+        Net.sendMessage(removedConnectionId, sync.serverMessage(flagRemoveFromRoom, userId, msg.body))
+    }
+
+    Net.sendMessage(connectionId, sync.serverMessage(flagRemoveFromRoom, msg.from, msg.body))
+    return flagProceed
+}
+
+//goland:noinspection GoRedundantConversion
+func (sync *syncT) roomLeavingRequested(connectionId uint32, msg *message) int32 {
+    if msg.body == nil || msg.size != intSize { return sync.finishWithError(connectionId, reasonMalformedMessage) }
+
+    var roomId uint32
+    copy(unsafe.Slice((*byte) (unsafe.Pointer(&roomId)), intSize), msg.body)
+
+    sync.rwMutex.Lock()
+    room, flag := sync.findRoomOfMember(connectionId, roomId, msg.from)
+
+    left := false
+    var err error = nil
+    if room != nil { left, err = database.LeaveRoom(room, msg.from) }
+    sync.rwMutex.Unlock()
+
+    if flag == flagFinishWithError { return flag }
+    if err != nil { return sync.finishWithError(connectionId, reasonDatabaseFailure) }
+
+    if !left {
+        Net.sendMessage(connectionId, sync.errorMessage(flagLeaveRoom, msg.from))
+        return flagError
+    }
+
+    Net.sendMessage(connectionId, sync.serverMessage(flagLeaveRoom, msg.from, msg.body))
+    return flagProceed
+}
+
+func (sync *syncT) roomsListRequested(connectionId uint32, userId uint32) int32 {
+    sync.rwMutex.RLock()
+    rooms, err := database.GetUserRooms(userId)
+    sync.rwMutex.RUnlock()
+
+    if err != nil { return sync.finishWithError(connectionId, reasonDatabaseFailure) }
+
+    if len(rooms) == 0 {
+        Net.sendMessage(connectionId, sync.simpleServerMessage(flagFetchRooms, userId))
+        return flagProceed
+    }
+
+    infosPerMessage := uint32(math.Floor(float64(maxMessageBodySize) / float64(roomInfoSize)))
+    messagesCount := uint32(math.Ceil(float64(len(rooms)) / float64(infosPerMessage)))
+
+    for messageIndex := uint32(0); messageIndex < messagesCount; messageIndex++ {
+        var roomInfosBytes []byte
+
+        for i := messageIndex * infosPerMessage; i < (messageIndex + 1) * infosPerMessage && i < uint32(len(rooms)); i++ {
+            roomInfosBytes = append(roomInfosBytes, Net.packRoomInfo(Net.makeRoomInfo(&(rooms[i])))...)
+        }
+
+        Net.sendMessageWaiting(connectionId, &message{
+            flag: flagFetchRooms,
+            timestamp: utils.CurrentTimeMillis(),
+            size: uint32(len(roomInfosBytes)),
+            index: messageIndex,
+            count: messagesCount,
+            from: fromServer,
+            to: userId,
+            token: sync.serverToken(),
+            body: roomInfosBytes,
+        })
+    }
+
+    return flagProceed
+}
+
+func (sync *syncT) roomMessageRequested(connectionId uint32, msg *message) int32 { // fans out to the online members, stores & queues for everyone except the sender until acknowledged, validates parts the same way proceedRequested does
+    if msg.size == 0 || msg.body == nil { return sync.finishWithError(connectionId, reasonMalformedMessage) }
+
+    sync.rwMutex.RLock()
+    room, flag := sync.findRoomOfMember(connectionId, msg.to, msg.from)
+
+    var members []uint32 = nil
+    var err error = nil
+    if room != nil { members, err = database.GetRoomMembers(room.Id) }
+    sync.rwMutex.RUnlock()
+
+    if flag == flagFinishWithError { return flag }
+    if err != nil { return sync.finishWithError(connectionId, reasonDatabaseFailure) }
+
+    if room == nil {
+        Net.sendMessage(connectionId, sync.errorMessage(flagRoomMessage, msg.from))
+        return flagError
+    }
+
+    sequences := connections.getRoomSequences(connectionId)
+    if sequences == nil { return flagFinish }
+
+    state, completed := sequences.accept(msg, Net.maxMultipartMessageSize, Net.reassembleMessages)
+    if state == sequenceViolated { return sync.finishWithError(connectionId, reasonInvalidSequence) }
+
+    for _, member := range members { // parts are relayed as they come
+        if member == msg.from { continue }
+
+        if memberConnectionId, memberUser := connections.getAuthorizedConnectedUser(member); memberUser != nil {
+            Net.sendMessage(memberConnectionId, &message{
+                flag: flagRoomMessage,
+                timestamp: msg.timestamp,
+                size: msg.size,
+                index: msg.index,
+                count: msg.count,
+                from: msg.from,
+                to: room.Id,
+                token: sync.serverToken(),
+                body: msg.body,
+            })
+        }
+    }
+
+    timestamp, body := msg.timestamp, msg.body
+    if Net.reassembleMessages {
+        if completed == nil { return flagProceed } // the whole message will be stored when the last part arrives
+        timestamp, body = completed.timestamp, completed.body
+    }
+
+    id := database.NextMessageId()
+
+    sync.rwMutex.Lock()
+    err = database.AddRoomMessage(id, timestamp, msg.from, room.Id, body)
+
+    for _, member := range members {
+        if err != nil { break }
+        if member != msg.from { err = database.EnqueueRoomMessage(id, timestamp, msg.from, member, room.Id, body) }
+    }
+    sync.rwMutex.Unlock()
+
+    if err != nil { return sync.finishWithError(connectionId, reasonDatabaseFailure) }
+
+    stored := []database.Message{{Id: id, Timestamp: timestamp, From: msg.from, Room: room.Id}} // the same record for everyone
+    ids := Net.packMessageIds(stored)
+
+    for _, member := range members {
+        if member == msg.from { continue }
+
+        if memberConnectionId, memberUser := connections.getAuthorizedConnectedUser(member); memberUser != nil {
+            Net.sendMessage(memberConnectionId, sync.serverMessage(flagMessageIds, member, ids)) // follows the relayed message, so the member can acknowledge it
+        }
+    }
+
+    sync.sendMessageIds(connectionId, msg.from, stored) // the acknowledgement
+    return flagProceed
+}
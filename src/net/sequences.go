@@ -0,0 +1,87 @@
+/*
+ * Exchatge - a secured realtime message exchanger (server).
+ * Copyright (C) 2023-2024  Vadim Nikolaev (https://github.com/vadniks)
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+
+package net
+
+import "ExchatgeServer/utils"
+
+const sequenceTimeout = 60000 // milliseconds, all parts of a multipart message must arrive within this time
+
+const (
+    sequencePartAccepted = 0 // more parts are expected
+    sequenceCompleted = 1 // the last part has arrived (or the message is a single-part one)
+    sequenceViolated = 2 // inconsistent count, non-contiguous index, timeout or size limit exceeding
+)
+
+type sequenceT struct {
+    count uint32
+    nextIndex uint32
+    startedMillis uint64
+    timestamp uint64 // of the first part
+    totalSize uint32
+    body []byte // concatenated bodies of the received parts, nillable, only when reassembling
+}
+
+type sequencesT struct { // multipart messages which are being received from one client; accessed only by the client's connection goroutine
+    entries map[uint32/*to*/]*sequenceT
+}
+
+func makeSequences() *sequencesT { return &sequencesT{make(map[uint32]*sequenceT)} }
+
+func (sequences *sequencesT) accept(msg *message, maxTotalSize uint32, reassemble bool) (int, *sequenceT) { // returns the state and the completed sequence (nillable)
+    utils.Assert(msg != nil)
+    now := utils.CurrentTimeMillis()
+
+    if msg.count == 0 || msg.index >= msg.count { return sequenceViolated, nil }
+
+    current, inProgress := sequences.entries[msg.to]
+    if inProgress && now - current.startedMillis > sequenceTimeout {
+        delete(sequences.entries, msg.to)
+        if msg.index > 0 { return sequenceViolated, nil } // the rest of the expired message
+        inProgress = false
+    }
+
+    if msg.count == 1 {
+        if inProgress { return sequenceViolated, nil } // parts of different messages to the same recipient mustn't interleave
+        return sequenceCompleted, &sequenceT{1, 1, now, msg.timestamp, msg.size, msg.body}
+    }
+
+    if msg.index == 0 {
+        if inProgress { return sequenceViolated, nil }
+        current = &sequenceT{msg.count, 0, now, msg.timestamp, 0, nil}
+        sequences.entries[msg.to] = current
+    } else if !inProgress || msg.count != current.count || msg.index != current.nextIndex {
+        delete(sequences.entries, msg.to)
+        return sequenceViolated, nil
+    }
+
+    if current.totalSize + msg.size > maxTotalSize {
+        delete(sequences.entries, msg.to)
+        return sequenceViolated, nil
+    }
+
+    current.totalSize += msg.size
+    current.nextIndex++
+    if reassemble { current.body = append(current.body, msg.body...) }
+
+    if current.nextIndex < current.count { return sequencePartAccepted, nil }
+
+    delete(sequences.entries, msg.to)
+    return sequenceCompleted, current
+}
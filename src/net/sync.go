@@ -21,7 +21,9 @@ package net
 import (
     "ExchatgeServer/crypto"
     "ExchatgeServer/database"
+    "ExchatgeServer/logging"
     "ExchatgeServer/utils"
+    "fmt"
     "math"
     goSync "sync"
     "unsafe"
@@ -40,6 +42,8 @@ const (
     flagError int32 = 0x00000009
     flagFetchUsers int32 = 0x0000000c
     flagFetchMessages int32 = 0x0000000d
+    flagAcknowledge int32 = 0x0000000e // client confirms receiving of queued messages so they can be removed from its queue; body: their ids (see flagMessageIds)
+    flagMessageSize int32 = 0x0000000f // client asks for a larger message size, server replies with the granted one
     flagExchangeKeys = 0x000000a0
     flagExchangeKeysDone = 0x000000b0
     flagExchangeHeaders = 0x000000c0
@@ -61,14 +65,30 @@ const (
 
     fromAnonymous uint32 = 0xffffffff
     fromServer uint32 = 0x7fffffff
+
+    reasonMalformedMessage int32 = 0x00000001 // reasons are sent in the body of the flagFinishWithError message right before closing the connection
+    reasonDecryptionFailed int32 = 0x00000002
+    reasonDatabaseFailure int32 = 0x00000003
+    reasonInvalidSequence int32 = 0x00000004 // parts of a multipart message are inconsistent, late or too large in total
+    reasonRateLimited int32 = 0x00000005 // the client has exceeded the rate limits too many times in a row
 )
 
+var reasonNames = map[int32]string{
+    reasonMalformedMessage: "malformedMessage",
+    reasonDecryptionFailed: "decryptionFailed",
+    reasonDatabaseFailure: "databaseFailure",
+    reasonInvalidSequence: "invalidSequence",
+    reasonRateLimited: "rateLimited",
+}
+
 type syncT struct {
     maxUsersCount uint32
     tokenAnonymous []byte
     tokenServer [crypto.TokenSize]byte
+    tokenServerNext [crypto.TokenSize]byte // signed by the next signing key, replaces tokenServer after the cutover
     rwMutex goSync.RWMutex
     shuttingDown bool
+    registrationLocked bool // toggled by the admin
 }
 
 var sync *syncT = nil // aka singleton
@@ -79,11 +99,17 @@ func syncInitialize(maxUsersCount uint) {
         uint32(maxUsersCount),
         make([]byte, crypto.TokenSize), // all zeroes
         crypto.MakeServerToken(maxMessageBodySize),
+        crypto.MakeNextServerToken(maxMessageBodySize),
         goSync.RWMutex{},
         false,
+        false,
     }
 }
 
+func (sync *syncT) serverToken() [crypto.TokenSize]byte {
+    if crypto.SignKeyRotated() { return sync.tokenServerNext } else { return sync.tokenServer }
+}
+
 func (sync *syncT) simpleServerMessage(xFlag int32, xTo uint32) *message {
     return &message{
         flag: xFlag,
@@ -93,7 +119,7 @@ func (sync *syncT) simpleServerMessage(xFlag int32, xTo uint32) *message {
         count: 1,
         from: fromServer,
         to: xTo,
-        token: sync.tokenServer,
+        token: sync.serverToken(),
         body: nil,
     }
 }
@@ -108,7 +134,7 @@ func (sync *syncT) errorMessage(originalFlag int32, xTo uint32) *message { // if
         count: 1,
         from: fromServer,
         to: xTo,
-        token: sync.tokenServer,
+        token: sync.serverToken(),
         body: append([]byte(nil), unsafe.Slice((*byte) (unsafe.Pointer(&originalFlag)), intSize)...),
     }
 }
@@ -125,21 +151,47 @@ func (sync *syncT) serverMessage(xFlag int32, xTo uint32, xBody []byte /*nillabl
         count: 1,
         from: fromServer,
         to: xTo,
-        token: sync.tokenServer,
+        token: sync.serverToken(),
         body: xBody,
     }
 
     return result
 }
 
+//goland:noinspection GoRedundantConversion
+func (sync *syncT) finishWithErrorMessage(reason int32, xTo uint32) *message {
+    return &message{
+        flag: flagFinishWithError,
+        timestamp: utils.CurrentTimeMillis(),
+        size: intSize,
+        index: 0,
+        count: 1,
+        from: fromServer,
+        to: xTo,
+        token: sync.serverToken(),
+        body: append([]byte(nil), unsafe.Slice((*byte) (unsafe.Pointer(&reason)), intSize)...),
+    }
+}
+
+func (sync *syncT) finishWithError(connectionId uint32, reason int32) int32 { // closes only the offending connection, others aren't affected
+    to := toAnonymous
+    if userId := connections.getConnectedUserId(connectionId); userId != nil { to = *userId }
+
+    logging.Warning("connection finished with error", logging.ConnectionId(connectionId), logging.UserId(to), logging.F("reason", reasonNames[reason]))
+    Net.sendMessage(connectionId, sync.finishWithErrorMessage(reason, to))
+    sync.finishRequested(connectionId)
+    return flagFinishWithError
+}
+
 func (sync *syncT) kickUserCuzOfDenialOfAccess(originalFlag int32, connectionId uint32, userId uint32) int32 {
     Net.sendMessage(connectionId, sync.errorMessage(originalFlag, userId))
     sync.finishRequested(connectionId)
     return flagFinishWithError
 }
 
-func (sync *syncT) shutdownRequested(connectionId uint32, user *database.User, msg *message) int32 { // TODO: add more administrative actions, such as: logging in and registration blocking, user ban...
-    utils.Assert(user != nil && msg.to == toServer && msg.size == 0)
+func (sync *syncT) shutdownRequested(connectionId uint32, user *database.User, msg *message) int32 { // other administrative actions are in admin.go
+    utils.Assert(user != nil)
+    if msg.to != toServer || msg.size != 0 { return sync.finishWithError(connectionId, reasonMalformedMessage) }
     if !database.IsAdmin(user) { return sync.kickUserCuzOfDenialOfAccess(flagShutdown, connectionId, user.Id) }
 
     sync.finishRequested(connectionId)
@@ -148,15 +200,12 @@ func (sync *syncT) shutdownRequested(connectionId uint32, user *database.User, m
     sync.shuttingDown = true
     sync.rwMutex.Unlock()
 
-    sync.rwMutex.Lock()
-    database.DeleteAllMessagesFromAllUsers()
-    sync.rwMutex.Unlock()
-
     return flagShutdown
 }
 
 func (sync *syncT) broadcastRequested(connectionId uint32, user *database.User, msg *message) int32 {
-    utils.Assert(user != nil && msg.to == toServer && msg.size > 0 && msg.body != nil)
+    utils.Assert(user != nil)
+    if msg.to != toServer || msg.size == 0 || msg.body == nil { return sync.finishWithError(connectionId, reasonMalformedMessage) }
     if !database.IsAdmin(user) { return sync.kickUserCuzOfDenialOfAccess(flagBroadcast, connectionId, user.Id) }
 
     connections.doForEachConnectedAuthorizedUser(func(connectionId uint32, xUser *connectedUser) {
@@ -169,7 +218,7 @@ func (sync *syncT) broadcastRequested(connectionId uint32, user *database.User,
             count: 1,
             from: fromServer,
             to: xUser.user.Id,
-            token: sync.tokenServer,
+            token: sync.serverToken(),
             body: msg.body,
         })
     })
@@ -177,24 +226,131 @@ func (sync *syncT) broadcastRequested(connectionId uint32, user *database.User,
     return flagProceed
 }
 
-func (sync *syncT) proceedRequested(msg *message) int32 {
-    utils.Assert(msg != nil && msg.to != msg.from && msg.size > 0 && msg.body != nil)
+func (sync *syncT) proceedRequested(connectionId uint32, msg *message) int32 {
+    utils.Assert(msg != nil)
+    if msg.to == msg.from || msg.size == 0 || msg.body == nil { return sync.finishWithError(connectionId, reasonMalformedMessage) }
+
+    var completed *sequenceT = nil
+    if msg.flag == flagProceed { // multipart messages are validated regardless of whether they're reassembled
+        sequences := connections.getSequences(connectionId)
+        if sequences == nil { return flagFinish }
+
+        var state int
+        state, completed = sequences.accept(msg, Net.maxMultipartMessageSize, Net.reassembleMessages)
+        if state == sequenceViolated { return sync.finishWithError(connectionId, reasonInvalidSequence) }
+    }
+
+    toUserConnectionId, toUser := connections.getAuthorizedConnectedUser(msg.to)
+    if toUser != nil {
+        Net.sendMessage(toUserConnectionId, msg) // parts are relayed as they come
+    }
+
+    if msg.flag != flagProceed { return flagProceed }
+
+    if sync.degraded() { // relayed but not stored, an offline recipient won't get it
+        if toUser == nil { return sync.serviceDegraded(connectionId, msg.flag, msg.from) }
+        return flagProceed
+    } // since this function is called not only with actual proceed but with exchange* flags too. Others are ignored by the server cuz it's clients' deal to handle 'em
 
-    if toUserConnectionId, toUser := connections.getAuthorizedConnectedUser(msg.to); toUser != nil {
-        Net.sendMessage(toUserConnectionId, msg)
+    timestamp, body := msg.timestamp, msg.body
+    if Net.reassembleMessages {
+        if completed == nil { return flagProceed } // the whole message will be stored when the last part arrives
+        timestamp, body = completed.timestamp, completed.body
     }
 
-    if msg.flag != flagProceed { return flagProceed } // since this function is called not only with actual proceed but with exchange* flags too. Others are ignored by the server cuz it's clients' deal to handle 'em
+    id := database.NextMessageId()
 
     sync.rwMutex.Lock() // save messages only with proceed flag
-    database.AddMessage(msg.timestamp, msg.from, msg.to, msg.body)
+    err := database.AddMessage(id, timestamp, msg.from, msg.to, body)
+
+    var exists bool
+    if err == nil { exists, err = database.UserExists(msg.to) }
+    if err == nil && exists { err = database.EnqueueMessage(id, timestamp, msg.from, msg.to, body) } // stays in the queue until the recipient acknowledges it, even if it has just been relayed, as the recipient may drop right after the relaying
+    if err == nil && toUser != nil { err = sync.changeMessageStatus(msg.to, id, database.MessageDelivered) }
     sync.rwMutex.Unlock()
 
+    if err != nil { return sync.finishWithError(connectionId, reasonDatabaseFailure) }
+
+    stored := []database.Message{{Id: id, Timestamp: timestamp, From: msg.from, To: msg.to}}
+    sync.sendMessageIds(connectionId, msg.from, stored) // the acknowledgement
+    if toUser != nil { Net.sendMessage(toUserConnectionId, sync.serverMessage(flagMessageIds, msg.to, Net.packMessageIds(stored))) } // follows the relayed message, doesn't wait for the recipient
+
+    return flagProceed
+}
+
+func (sync *syncT) storedMessage(flag int32, xMessage *database.Message, index uint32, count uint32, to uint32) *message {
+    body := xMessage.Body
+    if len(body) == 0 { body = nil } // a tombstone, which the database driver may decode as an empty slice
+
+    return &message{
+        flag,
+        xMessage.Timestamp,
+        uint32(len(body)),
+        index,
+        count,
+        xMessage.From,
+        to,
+        sync.serverToken(),
+        body,
+    }
+}
+
+func (sync *syncT) queuedMessagesPushRequested(connectionId uint32, userId uint32) int32 {
+    sync.rwMutex.RLock()
+    queued, err := database.GetQueuedMessages(userId)
+    sync.rwMutex.RUnlock()
+
+    if err != nil { return sync.finishWithError(connectionId, reasonDatabaseFailure) }
+
+    for _, xMessage := range queued {
+        flag, to := flagProceed, userId
+        if xMessage.Room > 0 { flag, to = flagRoomMessage, xMessage.Room }
+
+        Net.sendMessageWaiting(connectionId, sync.storedMessage(flag, &xMessage, 0, 1, to))
+    }
+
+    sync.sendMessageIds(connectionId, userId, queued)
+    return sync.messagesDelivered(connectionId, userId, queued)
+}
+
+func (sync *syncT) acknowledgementRequested(connectionId uint32, msg *message) int32 { // body consists of the ids (see flagMessageIds) of the received messages
+    if msg.size == 0 || msg.size % longSize != 0 || msg.body == nil {
+        Net.sendMessage(connectionId, sync.errorMessage(flagAcknowledge, msg.from))
+        return flagError
+    }
+
+    sync.rwMutex.Lock()
+    for offset := uint32(0); offset < msg.size; offset += longSize {
+        if _, err := database.DequeueMessage(msg.from, Net.unpackId(msg.body[offset:])); err != nil {
+            sync.rwMutex.Unlock()
+            return sync.finishWithError(connectionId, reasonDatabaseFailure)
+        }
+    }
+    sync.rwMutex.Unlock()
+
+    return flagProceed
+}
+
+//goland:noinspection GoRedundantConversion
+func (sync *syncT) messageSizeRequested(connectionId uint32, msg *message) int32 { // the granted size is the requested one, limited by the server's maximum
+    if msg.size != intSize || msg.body == nil { return sync.finishWithError(connectionId, reasonMalformedMessage) }
+
+    var size uint32
+    copy(unsafe.Slice((*byte) (unsafe.Pointer(&size)), intSize), msg.body)
+
+    if size < uint32(maxMessageSize) { size = uint32(maxMessageSize) }
+    if size > Net.maxNegotiableMessageSize { size = Net.maxNegotiableMessageSize }
+
+    reply := sync.serverMessage(flagMessageSize, msg.from, append([]byte(nil), unsafe.Slice((*byte) (unsafe.Pointer(&size)), intSize)...))
+    Net.sendMessage(connectionId, reply) // queued with the previous size, as everything queued before it, since the client reads with that size until it gets the reply
+
+    connections.setMessageSize(connectionId, size) // only what's queued from now on goes with the new size
     return flagProceed
 }
 
-func (sync *syncT) parseCredentials(msg *message) (username []byte, unhashedPassword []byte) {
+func (sync *syncT) parseCredentials(msg *message) (username []byte, unhashedPassword []byte) { // nillable results, nil if the message is malformed
     utils.Assert(msg != nil && (msg.flag == flagLogIn || msg.flag == flagRegister))
+    if msg.body == nil || uint(msg.size) < usernameSize + UnhashedPasswordSize { return nil, nil }
 
     username = make([]byte, usernameSize)
     copy(username, unsafe.Slice(&(msg.body[0]), usernameSize))
@@ -205,25 +361,40 @@ func (sync *syncT) parseCredentials(msg *message) (username []byte, unhashedPass
     return username, unhashedPassword
 }
 
+//goland:noinspection GoRedundantConversion
+func (_ *syncT) parseIntPair(msg *message) (uint32, uint32, bool) { // e.g. room id & user id, the third result is false if the message is malformed
+    if msg.body == nil || msg.size != intSize * 2 { return 0, 0, false }
+
+    var first, second uint32
+    copy(unsafe.Slice((*byte) (unsafe.Pointer(&first)), intSize), msg.body)
+    copy(unsafe.Slice((*byte) (unsafe.Pointer(&second)), intSize), unsafe.Slice(&(msg.body[intSize]), intSize))
+
+    return first, second, true
+}
+
 func (sync *syncT) loggingInWithCredentialsRequested(connectionId uint32, msg *message) int32 { // expects the password not to be hashed in order to compare it with salted hash (which is always different)
-    utils.Assert(msg != nil && msg.size > 0 && msg.body != nil)
+    utils.Assert(msg != nil)
+
     username, unhashedPassword := sync.parseCredentials(msg)
+    if username == nil || unhashedPassword == nil { return sync.finishWithError(connectionId, reasonMalformedMessage) }
+
+    sync.rwMutex.RLock()
+    user, err := database.FindUser(username, unhashedPassword)
+    sync.rwMutex.RUnlock()
 
-    xUsernameSize := uint(len(username)); passwordSize := uint(len(unhashedPassword))
-    utils.Assert(
-        xUsernameSize > 0 && xUsernameSize <= usernameSize &&
-        passwordSize > 0 && passwordSize <= UnhashedPasswordSize,
-    )
+    if err != nil { return sync.finishWithError(connectionId, reasonDatabaseFailure) }
+    return sync.logIn(connectionId, user, flagLogIn)
+}
 
+func (sync *syncT) logIn(connectionId uint32, user *database.User /*nillable*/, originalFlag int32) int32 { // finishes the connection if the user wasn't found, is banned or is connected already
     sync.rwMutex.Lock()
-    user := database.FindUser(username, unhashedPassword)
 
     var xConnectedUser *database.User = nil
     if user != nil { _, xConnectedUser = connections.getAuthorizedConnectedUser(user.Id) }
 
-    if user == nil || xConnectedUser != nil {
+    if user == nil || user.Banned || xConnectedUser != nil {
         sync.rwMutex.Unlock()
-        Net.sendMessage(connectionId, sync.errorMessage(flagLogIn, toAnonymous))
+        Net.sendMessage(connectionId, sync.errorMessage(originalFlag, toAnonymous))
         sync.finishRequested(connectionId)
         return flagFinishWithError
     }
@@ -232,16 +403,28 @@ func (sync *syncT) loggingInWithCredentialsRequested(connectionId uint32, msg *m
     connections.setConnectionState(connectionId, stateLoggedWithCredentials)
 
     token := crypto.MakeToken(connectionId, user.Id) // won't compile if inline the variable
+    resumeToken := crypto.MakeResumeToken(user.Id, utils.CurrentTimeMillis())
     sync.rwMutex.Unlock()
-    Net.sendMessage(connectionId, sync.serverMessage(flagLoggedIn, user.Id, token[:])) // here's how a client obtains his id
-    return flagProceed
+    Net.sendMessage(connectionId, sync.serverMessage(flagLoggedIn, user.Id, append(token[:], resumeToken[:]...))) // here's how a client obtains his id, the resume token goes right after the token
+
+    return sync.queuedMessagesPushRequested(connectionId, user.Id) // deliver what has been sent to the user while they were offline
 }
 
 func (sync *syncT) registrationWithCredentialsRequested(connectionId uint32, msg *message) int32 {
-    utils.Assert(msg != nil && msg.size > 0 && msg.body != nil)
+    utils.Assert(msg != nil)
+
+    username, unhashedPassword := sync.parseCredentials(msg)
+    if username == nil || unhashedPassword == nil { return sync.finishWithError(connectionId, reasonMalformedMessage) }
 
     sync.rwMutex.Lock()
-    if database.GetUsersCount() >= sync.maxUsersCount {
+    usersCount, err := database.GetUsersCount()
+
+    if err != nil {
+        sync.rwMutex.Unlock()
+        return sync.finishWithError(connectionId, reasonDatabaseFailure)
+    }
+
+    if usersCount >= sync.maxUsersCount || sync.registrationLocked {
         sync.rwMutex.Unlock()
         Net.sendMessage(connectionId, sync.errorMessage(flagRegister, toAnonymous))
         sync.finishRequested(connectionId)
@@ -256,7 +439,6 @@ func (sync *syncT) registrationWithCredentialsRequested(connectionId uint32, msg
         return zeroes
     }
 
-    username, unhashedPassword := sync.parseCredentials(msg)
     var user *database.User = nil
 
     usernameNonZeroes := usernameSize - countZeroes(username)
@@ -264,12 +446,14 @@ func (sync *syncT) registrationWithCredentialsRequested(connectionId uint32, msg
 
     if usernameNonZeroes >= minCredentialSize && usernameNonZeroes <= usernameSize &&
         unhashedPasswordNonZeroes >= minCredentialSize && unhashedPasswordNonZeroes <= UnhashedPasswordSize {
-        user = database.AddUser(username, crypto.Hash(unhashedPassword))
+        user, err = database.AddUser(username, crypto.Hash(unhashedPassword))
     }
 
     successful := user != nil
 
     sync.rwMutex.Unlock()
+    if err != nil { return sync.finishWithError(connectionId, reasonDatabaseFailure) }
+
     Net.sendMessage(connectionId, func() *message { // Lack of ternary operator is awful. Presence of closures/anonymous functions is great.
         if successful { return sync.simpleServerMessage(flagRegistered, user.Id) } else { return sync.errorMessage(flagRegister, toAnonymous) }
     }())
@@ -278,10 +462,41 @@ func (sync *syncT) registrationWithCredentialsRequested(connectionId uint32, msg
     if successful { return flagFinishToReconnect } else { return flagFinishWithError }
 }
 
+func (sync *syncT) sendRecords(connectionId uint32, flag int32, to uint32, records []byte, recordSize uint) { // a bulk reply, splits fixed size records between messages so that none of them is cut, sends an empty message if there are no records
+    utils.Assert(len(records) % int(recordSize) == 0)
+
+    if len(records) == 0 {
+        Net.sendMessage(connectionId, sync.simpleServerMessage(flag, to))
+        return
+    }
+
+    bytesPerMessage := uint32(maxMessageBodySize) / uint32(recordSize) * uint32(recordSize)
+    messagesCount := uint32(math.Ceil(float64(len(records)) / float64(bytesPerMessage)))
+
+    for messageIndex := uint32(0); messageIndex < messagesCount; messageIndex++ {
+        body := records[messageIndex * bytesPerMessage:]
+        if uint32(len(body)) > bytesPerMessage { body = body[:bytesPerMessage] }
+
+        Net.sendMessageWaiting(connectionId, &message{
+            flag: flag,
+            timestamp: utils.CurrentTimeMillis(),
+            size: uint32(len(body)),
+            index: messageIndex,
+            count: messagesCount,
+            from: fromServer,
+            to: to,
+            token: sync.serverToken(),
+            body: body,
+        })
+    }
+}
+
 func (sync *syncT) finishRequested(connectionId uint32) int32 {
     sync.rwMutex.Lock() // TODO: redundant locks usage here
-    connections.deleteConnection(connectionId)
+    xDisconnection := connections.deleteConnection(connectionId)
     sync.rwMutex.Unlock()
+
+    sync.storeLastSeen(xDisconnection)
     return flagFinish
 }
 
@@ -289,8 +504,14 @@ func (sync *syncT) finishRequested(connectionId uint32) int32 {
 func (sync *syncT) usersListRequested(connectionId uint32, userId uint32) int32 {
     sync.rwMutex.RLock()
 
-    registeredUsers := database.GetAllUsers()
+    registeredUsers, err := database.GetAllUsers()
+    if err != nil {
+        sync.rwMutex.RUnlock()
+        return sync.finishWithError(connectionId, reasonDatabaseFailure)
+    }
+
     var userInfosBytes []byte
+    var replies []*message // sent after unlocking as the client may read them slowly
 
     infosPerMessage := uint32(math.Floor(float64(maxMessageBodySize) / float64(userInfoSize)))
     utils.Assert(infosPerMessage <= uint32(maxMessageBodySize))
@@ -320,7 +541,7 @@ func (sync *syncT) usersListRequested(connectionId uint32, userId uint32) int32
         size := infosCount * uint32(userInfoSize)
         utils.Assert(len(userInfosBytes) == int(size))
 
-        Net.sendMessage(connectionId, &message{
+        replies = append(replies, &message{
             flag: flagFetchUsers,
             timestamp: utils.CurrentTimeMillis(),
             size: size,
@@ -328,7 +549,7 @@ func (sync *syncT) usersListRequested(connectionId uint32, userId uint32) int32
             count: messagesCount,
             from: fromServer,
             to: userId,
-            token: sync.tokenServer,
+            token: sync.serverToken(),
             body: userInfosBytes,
         })
         messageIndex++
@@ -338,42 +559,51 @@ func (sync *syncT) usersListRequested(connectionId uint32, userId uint32) int32
     }
 
     sync.rwMutex.RUnlock()
+
+    for _, reply := range replies { Net.sendMessageWaiting(connectionId, reply) }
     return flagProceed
 }
 
 //goland:noinspection GoRedundantConversion
 func (sync *syncT) messagesRequested(connectionId uint32, msg *message) int32 {
-    utils.Assert(msg.size > 0 && msg.body != nil)
-
     const byteSize = 1
     utils.Assert(unsafe.Sizeof(true) == byteSize)
     const intSize = unsafe.Sizeof(int32(0))
     const longSize = unsafe.Sizeof(int64(0))
 
+    if msg.body == nil || uintptr(msg.size) < byteSize + longSize { return sync.finishWithError(connectionId, reasonMalformedMessage) }
+    if msg.body[0] == fetchModeConversation || msg.body[0] == fetchModeRoom { return sync.conversationRequested(connectionId, msg) }
+
     fromMode := msg.body[0]
-    utils.Assert(fromMode == 0 || fromMode == 1)
+    if fromMode != 0 && fromMode != 1 { return sync.finishWithError(connectionId, reasonMalformedMessage) }
 
     var afterTimestamp uint64
     copy(unsafe.Slice((*byte) (unsafe.Pointer(&afterTimestamp)), longSize), unsafe.Slice((*byte) (&(msg.body[byteSize])), longSize))
-    utils.Assert(afterTimestamp < utils.CurrentTimeMillis())
+    if afterTimestamp >= utils.CurrentTimeMillis() { return sync.finishWithError(connectionId, reasonMalformedMessage) }
 
     var fromUser uint32
     if fromMode == 0 {
         fromUser = msg.from
     } else {
+        if uintptr(msg.size) < byteSize + longSize + intSize { return sync.finishWithError(connectionId, reasonMalformedMessage) }
         copy(unsafe.Slice((*byte) (unsafe.Pointer(&fromUser)), intSize), unsafe.Slice((*byte) (&(msg.body[byteSize + longSize])), intSize))
-        utils.Assert(fromUser < sync.maxUsersCount)
+        if fromUser >= sync.maxUsersCount { return sync.finishWithError(connectionId, reasonMalformedMessage) }
     }
 
-    if !database.UserExists(fromUser) {
+    exists, err := database.UserExists(fromUser)
+    if err != nil { return sync.finishWithError(connectionId, reasonDatabaseFailure) }
+
+    if !exists {
         Net.sendMessage(connectionId, sync.errorMessage(flagFetchMessages, msg.from))
         return flagError
     }
 
     sync.rwMutex.RLock()
-    messages := database.GetMessagesFromOrForUser(fromMode == 1, fromUser, afterTimestamp)
+    messages, err := database.GetMessagesFromOrForUser(fromMode == 1, fromUser, afterTimestamp)
     sync.rwMutex.RUnlock()
 
+    if err != nil { return sync.finishWithError(connectionId, reasonDatabaseFailure) }
+
     count := len(messages)
 
     if count == 0 {
@@ -390,27 +620,18 @@ func (sync *syncT) messagesRequested(connectionId uint32, msg *message) int32 {
             1,
             fromServer,
             msg.from,
-            sync.tokenServer,
+            sync.serverToken(),
             replyBody,
         })
         return flagProceed
     }
 
-    for index, xMessage := range messages {
-        Net.sendMessage(connectionId, &message{
-            flagFetchMessages,
-            xMessage.Timestamp,
-            uint32(len(xMessage.Body)),
-            uint32(index),
-            uint32(count),
-            xMessage.From,
-            msg.from,
-            sync.tokenServer,
-            xMessage.Body,
-        })
+    for index := range messages {
+        Net.sendMessageWaiting(connectionId, sync.storedMessage(flagFetchMessages, &(messages[index]), uint32(index), uint32(count), msg.from))
     }
 
-    return flagProceed
+    sync.sendMessageIds(connectionId, msg.from, messages)
+    return sync.messagesDelivered(connectionId, msg.from, messages)
 }
 
 func (sync *syncT) routeMessage(connectionId uint32, msg *message) int32 {
@@ -421,15 +642,20 @@ func (sync *syncT) routeMessage(connectionId uint32, msg *message) int32 {
     sync.rwMutex.Lock()
 
     state := connections.getConnectionState(connectionId)
-    utils.Assert(state != nil)
+    if state == nil { // the connection has been finished by someone else meanwhile
+        sync.rwMutex.Unlock()
+        logging.Debug("message to a finished connection dropped", logging.ConnectionId(connectionId), logging.Flag(flag))
+        return flagFinish
+    }
     userId := connections.getConnectedUserId(connectionId)
 
-    interruptConnection := func(flag int32, to uint32) {
+    interruptConnection := func(flag int32, to uint32, cause string) {
+        logging.Warning("connection interrupted", logging.ConnectionId(connectionId), logging.UserId(to), logging.Flag(msg.flag), logging.F("cause", cause))
         Net.sendMessage(connectionId, sync.errorMessage(flag, to))
         sync.finishRequested(connectionId)
     }
 
-    if flag == flagLogIn || flag == flagRegister {
+    if flag == flagLogIn || flag == flagRegister || flag == flagResume {
         if !(*state == stateConnected && // state associated with this connectionId exist yet (non-existent map entry defaults to typed zero value)
             msg.from == fromAnonymous &&
             xConnectionId == nil &&
@@ -437,11 +663,17 @@ func (sync *syncT) routeMessage(connectionId uint32, msg *message) int32 {
             msg.to == toServer) {
 
             sync.rwMutex.Unlock()
-            interruptConnection(flagError, toAnonymous)
+            interruptConnection(flagError, toAnonymous, "authentication requested in a wrong state")
             return flagFinishWithError
         }
 
         connections.setConnectionState(connectionId, stateSecureConnectionEstablished)
+    } else if flag == flagSignKeys && msg.from == fromAnonymous {
+        if !(xConnectionId == nil && userIdFromToken == nil && msg.to == toServer) {
+            sync.rwMutex.Unlock()
+            interruptConnection(flagError, toAnonymous, "signing keys requested in a wrong state")
+            return flagFinishWithError
+        }
     } else {
         if !(*state > stateConnected &&
             userId != nil &&
@@ -449,7 +681,7 @@ func (sync *syncT) routeMessage(connectionId uint32, msg *message) int32 {
             msg.from != fromServer) {
 
             sync.rwMutex.Unlock()
-            interruptConnection(flagError, msg.from)
+            interruptConnection(flagError, msg.from, "not authenticated")
             return flagFinishWithError
         }
 
@@ -460,7 +692,7 @@ func (sync *syncT) routeMessage(connectionId uint32, msg *message) int32 {
             msg.from != *userIdFromToken {
 
             sync.rwMutex.Unlock()
-            interruptConnection(flagError, toAnonymous)
+            interruptConnection(flagError, toAnonymous, "invalid token")
             return flagFinishWithError
         }
     }
@@ -468,17 +700,36 @@ func (sync *syncT) routeMessage(connectionId uint32, msg *message) int32 {
     shuttingDown := sync.shuttingDown
     sync.rwMutex.Unlock()
 
+    to := toAnonymous
+    if userId != nil { to = *userId }
+
     if shuttingDown {
-        Net.sendMessage(connectionId, sync.simpleServerMessage(flagError, *userId))
+        logging.Debug("message rejected while shutting down", logging.ConnectionId(connectionId), logging.Flag(flag))
+        Net.sendMessage(connectionId, sync.simpleServerMessage(flagError, to))
         sync.finishRequested(connectionId)
         return flagFinishWithError
     }
 
+    if isRateLimited(msg) {
+        if waitMillis := Net.rateLimits.take(flag, connectionId, userId, connections.getAddress(connectionId)); waitMillis > 0 {
+            return sync.rateLimitExceeded(connectionId, flag, waitMillis)
+        }
+        connections.countRateLimitViolation(connectionId, false)
+    }
+
+    flagLabel := fmt.Sprintf("0x%08x", flag)
+    defer func() { routedMessages.Inc(flagLabel) }()
+
+    if requiresDatabase(flag) && sync.degraded() {
+        logging.Debug("request refused in the degraded mode", logging.ConnectionId(connectionId), logging.Flag(flag))
+        return sync.serviceDegraded(connectionId, flag, to)
+    }
+
     doIfToServerOrInterrupt := func(action func() int32) int32 {
         if msg.to == toServer {
             return action()
         } else {
-            interruptConnection(flagError, msg.from)
+            interruptConnection(flagError, msg.from, "must be sent to the server")
             return flagFinishWithError
         }
     }
@@ -493,21 +744,71 @@ func (sync *syncT) routeMessage(connectionId uint32, msg *message) int32 {
         case flagFileAsk: fallthrough
         case flagFile: fallthrough
         case flagProceed:
-            return sync.proceedRequested(msg)
+            return sync.proceedRequested(connectionId, msg)
         case flagLogIn:
             return doIfToServerOrInterrupt(func() int32 { return sync.loggingInWithCredentialsRequested(connectionId, msg) })
         case flagRegister:
             return doIfToServerOrInterrupt(func() int32 { return sync.registrationWithCredentialsRequested(connectionId, msg) })
+        case flagResume:
+            return doIfToServerOrInterrupt(func() int32 { return sync.resumeRequested(connectionId, msg) })
+        case flagSignKeys:
+            return doIfToServerOrInterrupt(func() int32 { return sync.signKeysRequested(connectionId, msg) })
+        case flagRevokeResumeTokens:
+            return doIfToServerOrInterrupt(func() int32 { return sync.resumeTokensRevocationRequested(connectionId, msg) })
         case flagFinish:
             return doIfToServerOrInterrupt(func() int32 { return sync.finishRequested(connectionId) })
         case flagFetchUsers:
             return doIfToServerOrInterrupt(func() int32 { return sync.usersListRequested(connectionId, *userIdFromToken) })
+        case flagSearchUsers:
+            return doIfToServerOrInterrupt(func() int32 { return sync.usersSearchRequested(connectionId, msg) })
+        case flagSubscribeToPresence:
+            return doIfToServerOrInterrupt(func() int32 { return sync.presenceSubscriptionRequested(connectionId, msg) })
+        case flagUnsubscribeFromPresence:
+            return doIfToServerOrInterrupt(func() int32 { return sync.presenceUnsubscriptionRequested(connectionId, msg) })
         case flagFetchMessages:
             return doIfToServerOrInterrupt(func() int32 { return sync.messagesRequested(connectionId, msg) })
+        case flagCreateRoom:
+            return doIfToServerOrInterrupt(func() int32 { return sync.roomCreationRequested(connectionId, msg) })
+        case flagInviteToRoom:
+            return doIfToServerOrInterrupt(func() int32 { return sync.roomInvitationRequested(connectionId, msg) })
+        case flagRemoveFromRoom:
+            return doIfToServerOrInterrupt(func() int32 { return sync.roomMemberRemovalRequested(connectionId, msg) })
+        case flagLeaveRoom:
+            return doIfToServerOrInterrupt(func() int32 { return sync.roomLeavingRequested(connectionId, msg) })
+        case flagFetchRooms:
+            return doIfToServerOrInterrupt(func() int32 { return sync.roomsListRequested(connectionId, *userIdFromToken) })
+        case flagRoomMessage:
+            return sync.roomMessageRequested(connectionId, msg)
+        case flagChangePassword:
+            return doIfToServerOrInterrupt(func() int32 { return sync.passwordChangeRequested(connectionId, connections.getUser(connectionId), msg) })
+        case flagChangeUsername:
+            return doIfToServerOrInterrupt(func() int32 { return sync.usernameChangeRequested(connectionId, connections.getUser(connectionId), msg) })
+        case flagDeleteAccount:
+            return doIfToServerOrInterrupt(func() int32 { return sync.accountDeletionRequested(connectionId, connections.getUser(connectionId), msg) })
+        case flagKick:
+            return sync.kickRequested(connectionId, connections.getUser(connectionId), msg)
+        case flagBan:
+            return sync.banRequested(connectionId, connections.getUser(connectionId), msg)
+        case flagLockRegistration:
+            return sync.registrationLockRequested(connectionId, connections.getUser(connectionId), msg)
+        case flagFetchConnections:
+            return sync.connectionsListRequested(connectionId, connections.getUser(connectionId), msg)
+        case flagPurgeMessages:
+            return sync.messagesPurgeRequested(connectionId, connections.getUser(connectionId), msg)
+        case flagEditMessage: fallthrough
+        case flagDeleteMessage:
+            return doIfToServerOrInterrupt(func() int32 { return sync.messageChangeRequested(connectionId, msg) })
+        case flagMessageSize:
+            return doIfToServerOrInterrupt(func() int32 { return sync.messageSizeRequested(connectionId, msg) })
+        case flagAcknowledge:
+            return doIfToServerOrInterrupt(func() int32 { return sync.acknowledgementRequested(connectionId, msg) })
+        case flagRead:
+            return doIfToServerOrInterrupt(func() int32 { return sync.readRequested(connectionId, msg) })
         case flagBroadcast:
             return sync.broadcastRequested(connectionId, connections.getUser(connectionId), msg)
         default:
-            interruptConnection(flagError, msg.from)
+            flagLabel = "unknown" // flags come from clients, so the unknown ones share a single series
+            interruptConnection(flagError, msg.from, "unknown flag")
             return flagFinishWithError
     }
 }
@@ -0,0 +1,86 @@
+/*
+ * Exchatge - a secured realtime message exchanger (server).
+ * Copyright (C) 2023-2024  Vadim Nikolaev (https://github.com/vadniks)
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+
+package options
+
+import (
+    "ExchatgeServer/crypto"
+    "ExchatgeServer/logging"
+    "ExchatgeServer/utils"
+    "bufio"
+    "encoding/hex"
+    "errors"
+    "fmt"
+    "io"
+    "os"
+    "strings"
+)
+
+const (
+    encryptionKeyEnv = envPrefix + "ENCRYPTION_KEY"
+    minEncryptionKeySize = 16
+)
+
+// The key which encrypts the secret options (mongodbUrl & adminPassword) is taken from the EXCHATGE_ENCRYPTION_KEY
+// environment variable, then from the key file, then it's derived from the machine id, whichever is found first.
+func loadEncryptionKey(keyFile string) ([]byte, error) {
+    if key, ok := os.LookupEnv(encryptionKeyEnv); ok { return deriveEncryptionKey(key, "environment variable " + encryptionKeyEnv) }
+
+    if len(keyFile) > 0 {
+        info, err := os.Stat(keyFile)
+        if err != nil { return nil, fmt.Errorf("unable to read the key file: %w", err) }
+        if info.Mode().Perm() & 0077 != 0 { logging.Warning("the options encryption key file is accessible by other users", logging.F("path", keyFile)) }
+
+        bytes, err := os.ReadFile(keyFile)
+        if err != nil { return nil, fmt.Errorf("unable to read the key file: %w", err) }
+        return deriveEncryptionKey(strings.TrimSpace(string(bytes)), "the key file")
+    }
+
+    machineId := utils.MachineIdBytes()
+    if machineId == nil { return nil, errors.New("no key: set " + encryptionKeyEnv + ", " + encryptionKeyFile + " or provide a machine id") }
+    return crypto.GenericHash(machineId, crypto.KeySize), nil
+}
+
+func deriveEncryptionKey(key string, source string) ([]byte, error) {
+    if len(key) < minEncryptionKeySize { return nil, fmt.Errorf("the key from %s must be at least %d characters long", source, minEncryptionKeySize) }
+    return crypto.GenericHash([]byte(key), crypto.KeySize), nil
+}
+
+// EncryptValue implements the encrypt subcommand: encrypts the value (the only argument after the flags or the first line
+// of the input if there are no arguments) with the same key the server would use and returns it hex encoded for options.txt.
+func EncryptValue(args []string, input io.Reader) (string, error) {
+    values, sources, rest, err := collect(args)
+    if err != nil { return "", err }
+    if len(rest) > 1 { return "", fmt.Errorf("unexpected argument %q", rest[1]) }
+
+    key, err := loadEncryptionKey(values[encryptionKeyFile])
+    if err != nil { return "", &Error{encryptionKeyFile, values[encryptionKeyFile], err.Error(), sources[encryptionKeyFile]} }
+
+    var value string
+    if len(rest) == 1 {
+        value = rest[0]
+    } else {
+        line, err := bufio.NewReader(input).ReadString('\n')
+        if err != nil && !errors.Is(err, io.EOF) { return "", err }
+        value = strings.TrimRight(line, "\r\n")
+    }
+    if len(value) == 0 { return "", errors.New("nothing to encrypt") }
+
+    return hex.EncodeToString(crypto.EncryptSingle([]byte(value), key)), nil
+}
@@ -0,0 +1,108 @@
+/*
+ * Exchatge - a secured realtime message exchanger (server).
+ * Copyright (C) 2023-2024  Vadim Nikolaev (https://github.com/vadniks)
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+
+package options
+
+import (
+    "ExchatgeServer/database"
+    "errors"
+    "os"
+    "strings"
+    "testing"
+)
+
+const (
+    testSignKey = "211,211,189,184,216,122,65,203,37,173,133,45,240,193,227,57,78,211,86,225,75,172,30,182,194,11,249,233,74,149,198,232,255,23,21,243,148,177,186,0,73,34,173,130,234,251,83,130,138,54,215,5,170,139,175,148,71,215,74,172,27,225,26,249"
+    testAdminPassword = "aed47fe85374d2a90d50b8205d0ddcb3670741b279ee5558de9b12c585dba68811778a603c887de7e5b92e86a9"
+    testEncryptionKey = "0123456789abcdef0123456789abcdef" // the one the sample options.txt is encrypted with
+)
+
+func writeOptions(t *testing.T, content string) string {
+    path := t.TempDir() + "/" + fileName
+    if os.WriteFile(path, []byte(content), 0600) != nil { t.Fatal() }
+    return path
+}
+
+func TestInit(t *testing.T) {
+    path := writeOptions(t, "# a comment\n\nserverPrivateSignKey=" + testSignKey + "\nadminPassword = " + testAdminPassword + "\nstorage=memory\nport=8081\n")
+    t.Setenv(encryptionKeyEnv, testEncryptionKey)
+    t.Setenv("EXCHATGE_PORT", "8082")
+    t.Setenv("EXCHATGE_MAX_USERS_COUNT", "10")
+
+    options, err := Init(64, 16, []string{"-config", path, "-port=8083"})
+    if err != nil { t.Fatal(err) }
+
+    if options.Port != 8083 || options.MaxUsersCount != 10 || options.Host != "0.0.0.0" || options.Storage != database.StorageMemory { t.Error(options) }
+    if string(options.AdminPassword[:5]) != "admin" || len(options.ServerPrivateSignKey) != 64 { t.Error() }
+}
+
+func TestInitErrors(t *testing.T) {
+    t.Setenv(encryptionKeyEnv, testEncryptionKey)
+    required := "serverPrivateSignKey=" + testSignKey + "\nadminPassword=" + testAdminPassword + "\n"
+
+    _, err := Init(64, 16, []string{"-config", writeOptions(t, required + "port\n")})
+    if err == nil || !strings.Contains(err.Error(), ":3: expected key=value") { t.Error(err) }
+
+    var optionError *Error
+
+    _, err = Init(64, 16, []string{"-config", writeOptions(t, required + "colour=red\n")})
+    if !errors.As(err, &optionError) || optionError.Key != "colour" || optionError.Reason != "unknown option" { t.Error(err) }
+
+    _, err = Init(64, 16, []string{"-config", writeOptions(t, required + "storage=memory\n"), "-maxMessageSize", "10"})
+    if !errors.As(err, &optionError) || optionError.Key != maxMessageSize || optionError.Value != "10" || optionError.Source != "flag -maxMessageSize" { t.Error(err) }
+
+    _, err = Init(64, 16, []string{"-config", writeOptions(t, required + "storage=memory\n"), "-maxStoredMessagesPerSender", "4294967296"})
+    if !errors.As(err, &optionError) || optionError.Key != maxStoredMessagesPerSender { t.Error(err) }
+
+    _, err = Init(64, 16, []string{"-config", writeOptions(t, "storage=memory\nadminPassword=" + testAdminPassword + "\n")})
+    if !errors.As(err, &optionError) || optionError.Key != serverPrivateSignKey || optionError.Reason != "is required" { t.Error(err) }
+
+    _, err = Init(64, 16, []string{"-config", writeOptions(t, required)})
+    if !errors.As(err, &optionError) || optionError.Key != mongodbUrl { t.Error(err) }
+
+    _, err = Init(64, 16, []string{"-config", writeOptions(t, required + "adminPassword=abcdef\n")})
+    if err == nil || strings.Contains(err.Error(), "abcdef") || !strings.Contains(err.Error(), hiddenValue) { t.Error(err) }
+
+    _, err = Init(64, 16, []string{"-config", t.TempDir() + "/missing.txt"})
+    if err == nil || !errors.Is(err, os.ErrNotExist) { t.Error(err) }
+}
+
+func TestEncryptValue(t *testing.T) {
+    keyFile := t.TempDir() + "/key"
+    if os.WriteFile(keyFile, []byte("a key from the file\n"), 0600) != nil { t.Fatal() }
+    config := writeOptions(t, "encryptionKeyFile=" + keyFile + "\n")
+
+    encrypted, err := EncryptValue([]string{"-config", config}, strings.NewReader("admin\n"))
+    if err != nil { t.Fatal(err) }
+
+    options, err := Init(64, 16, []string{"-config", config, "-storage=memory", "-serverPrivateSignKey=" + testSignKey, "-adminPassword=" + encrypted})
+    if err != nil || string(options.AdminPassword[:5]) != "admin" { t.Error(err) }
+
+    t.Setenv(encryptionKeyEnv, testEncryptionKey) // takes precedence over the file
+    _, err = Init(64, 16, []string{"-config", config, "-storage=memory", "-serverPrivateSignKey=" + testSignKey, "-adminPassword=" + encrypted})
+    if err == nil { t.Error() }
+
+    t.Setenv(encryptionKeyEnv, "short")
+    if _, err = EncryptValue([]string{"value"}, strings.NewReader("")); err == nil { t.Error() }
+}
+
+func TestEnvName(t *testing.T) {
+    if envName(maxTimeMillisToPreserveActiveConnection) != "MAX_TIME_MILLIS_TO_PRESERVE_ACTIVE_CONNECTION" { t.Error() }
+    if envName(configFlag) != "CONFIG" { t.Error() }
+}
@@ -0,0 +1,126 @@
+/*
+ * Exchatge - a secured realtime message exchanger (server).
+ * Copyright (C) 2023-2024  Vadim Nikolaev (https://github.com/vadniks)
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+
+package main
+
+import (
+    "ExchatgeServer/crypto"
+    "ExchatgeServer/logging"
+    "ExchatgeServer/options"
+    "encoding/hex"
+    "fmt"
+    "os"
+)
+
+const (
+    subcommandEncrypt = "encrypt" // ExchatgeServer encrypt [-config path] [-encryptionKeyFile path] [value]
+    subcommandGenerateKey = "generate-key" // ExchatgeServer generate-key
+    subcommandPublicKey = "public-key" // ExchatgeServer public-key [-config path] [-serverPrivateSignKey bytes]
+    subcommandVerifyKey = "verify-key" // same as public-key
+)
+
+func runSubcommand(name string, args []string) int { // returns the exit code
+    switch name {
+        case subcommandEncrypt: return encrypt(args)
+        case subcommandGenerateKey: return generateKey(args)
+        case subcommandPublicKey: return printPublicKey(args)
+        case subcommandVerifyKey: return verifyKey(args)
+        default:
+            logging.Error("unknown subcommand", logging.F("name", name))
+            return 2
+    }
+}
+
+func encrypt(args []string) int {
+    encrypted, err := options.EncryptValue(args, os.Stdin)
+    if err != nil {
+        logging.Error("unable to encrypt the value", logging.Err(err))
+        return 1
+    }
+
+    fmt.Println(encrypted)
+    return 0
+}
+
+func generateKey(args []string) int {
+    if len(args) > 0 {
+        logging.Error("unexpected argument", logging.F("argument", args[0]))
+        return 2
+    }
+
+    publicKey, secretKey := crypto.GenerateSignKeys()
+
+    fmt.Println("serverPrivateSignKey=" + options.FormatServerPrivateSignKey(secretKey))
+    printKey(publicKey)
+    return 0
+}
+
+func printKey(publicKey []byte) {
+    fmt.Println("# public key (hex): " + hex.EncodeToString(publicKey))
+    fmt.Println("# public key (bytes): " + options.FormatServerPrivateSignKey(publicKey))
+    fmt.Println("# fingerprint: " + crypto.Fingerprint(publicKey))
+}
+
+func loadKeys(args []string) ([]byte, []byte) { // nillable results, the second one is nil if no rotation is planned
+    key, nextKey, err := options.LoadServerPrivateSignKeys(args, crypto.SecretKeySize)
+    if err != nil {
+        logging.Error("unable to load the server's signing keys", logging.Err(err))
+        return nil, nil
+    }
+
+    crypto.Initialize(key)
+    return key, nextKey
+}
+
+func printPublicKey(args []string) int {
+    key, nextKey := loadKeys(args)
+    if key == nil { return 1 }
+
+    printKey(crypto.SignPublicKey())
+
+    if nextKey != nil {
+        crypto.Initialize(nextKey)
+        fmt.Println("# next:")
+        printKey(crypto.SignPublicKey())
+    }
+
+    return 0
+}
+
+func verifyKey(args []string) int {
+    key, nextKey := loadKeys(args)
+    if key == nil { return 1 }
+
+    names := []string{"serverPrivateSignKey", "nextServerPrivateSignKey"}
+    for index, xKey := range [][]byte{key, nextKey} {
+        if xKey == nil { continue }
+        crypto.Initialize(xKey)
+
+        publicKey := crypto.SignPublicKey()
+        if !crypto.CheckSignSecretKey(xKey) || crypto.VerifySignature(crypto.Sign(crypto.GenerateKey()), publicKey) == nil {
+            logging.Error("the signing key is malformed, generate a new one via the " + subcommandGenerateKey + " subcommand", logging.F("option", names[index]))
+            return 1
+        }
+
+        fmt.Println(names[index] + " is well formed")
+        printKey(publicKey)
+    }
+
+    return 0
+}
@@ -20,6 +20,7 @@ package utils
 
 import (
     "os"
+    "strings"
     "time"
 )
 
@@ -27,11 +28,21 @@ func JustThrow() { panic(any("")) }
 func Assert(condition bool) { if !condition { JustThrow() } }
 func CurrentTimeMillis() uint64 { return uint64(time.Now().UnixMilli()) }
 
+const machineIdFile = "/etc/machine-id"
+
 func MachineId() int64 {
-    bytes, err := os.ReadFile("/etc/machine-id")
+    bytes, err := os.ReadFile(machineIdFile)
     if err != nil { return int64(-1) }
 
     var id int64 = 0
     for _, i := range bytes { id ^= int64(i) }
     return id
 }
+
+func MachineIdBytes() []byte { // nillable
+    bytes, err := os.ReadFile(machineIdFile)
+    if err != nil { return nil }
+
+    id := strings.TrimSpace(string(bytes))
+    if len(id) == 0 { return nil } else { return []byte(id) }
+}